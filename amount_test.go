@@ -0,0 +1,57 @@
+package test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/getAlby/lsat-middleware/echolsat"
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/lsat"
+
+	"github.com/appleboy/gofight/v2"
+	decodepay "github.com/fiatjaf/ln-decodepay"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestAmountMsat(t *testing.T) {
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{})
+	lsatmiddleware.AmountMsatFunc = func(req *http.Request) (lnwire.MilliSatoshi, error) {
+		return 1500, nil
+	}
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	gofight.New().GET("/protected").
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPaymentRequired, res.Code)
+			assert.Equal(t, int64(1500), gjson.Get(res.Body.String(), "amount_msat").Int())
+			assert.Equal(t, int64(1), gjson.Get(res.Body.String(), "amount").Int())
+			decoded, err := decodepay.Decodepay(gjson.Get(res.Body.String(), "invoice").String())
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1500), decoded.MSatoshi)
+		})
+}
+
+func TestAmountPricingError(t *testing.T) {
+	for _, amountErr := range []error{errors.New("Rate unavailable"), nil} {
+		amountErr := amountErr
+		lsatmiddleware := mockLsatMiddleware(&MockLNClient{})
+		// A nil error prices the request at zero, which is rejected as well
+		lsatmiddleware.AmountMsatFunc = func(req *http.Request) (lnwire.MilliSatoshi, error) {
+			return 0, amountErr
+		}
+		for _, handler := range []http.Handler{
+			ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware}),
+			echoStrictLsatHandler(&echolsat.EchoLsat{Middleware: *lsatmiddleware}),
+		} {
+			gofight.New().GET("/protected").
+				Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+					assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+					assert.Contains(t, gjson.Get(res.Body.String(), "message").String(), lsat.ErrPricing.Error())
+					assert.Empty(t, res.HeaderMap.Get("Www-Authenticate"))
+				})
+		}
+	}
+}
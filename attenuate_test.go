@@ -0,0 +1,87 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/lsat"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttenuate(t *testing.T) {
+	lnClient := &MockLNClient{}
+	handler := strictLsatHandler(lnClient, withUsageStore())
+	authorization, _ := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+
+	restricted, err := lsat.Attenuate(authorization, []caveat.Caveat{
+		caveat.NewCaveat(caveat.PATH_PREFIX, "/protected"),
+		caveat.NewCaveat(caveat.METHODS, "GET"),
+		caveat.ValidUntil(time.Now().Add(time.Hour)),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", restricted))
+
+	for _, caveats := range [][]caveat.Caveat{
+		{caveat.NewCaveat(caveat.PATH_PREFIX, "/other")},
+		{caveat.NewCaveat(caveat.METHODS, "POST")},
+		{caveat.ValidUntil(time.Now().Add(-time.Minute))},
+		// Repeating a caveat can't widen it again
+		{caveat.NewCaveat(caveat.PATH_PREFIX, "/other"), caveat.NewCaveat(caveat.PATH_PREFIX, "/")},
+	} {
+		restricted, err := lsat.Attenuate(authorization, caveats)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/protected", restricted), caveats)
+	}
+
+	_, err = lsat.Attenuate(authorization, []caveat.Caveat{caveat.MaxUses(0)})
+	assert.Error(t, err)
+	_, err = lsat.Attenuate("LSAT not-a-token", []caveat.Caveat{caveat.MaxUses(1)})
+	assert.ErrorIs(t, err, lsat.ErrMalformedToken)
+}
+
+func TestAttenuateMaxUses(t *testing.T) {
+	lnClient := &MockLNClient{}
+	lsatmiddleware := mockLsatMiddleware(lnClient, withUsageStore())
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+	authorization, _ := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+
+	limited, err := lsat.Attenuate(authorization, []caveat.Caveat{caveat.MaxUses(2)})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", limited))
+
+	// Adding caveats to a limited LSAT keeps counting the same uses
+	derived, err := lsat.Attenuate(limited, []caveat.Caveat{caveat.NewCaveat(caveat.METHODS, "GET")})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", derived))
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/protected", derived))
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/protected", limited))
+
+	// The original LSAT isn't limited
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", authorization))
+
+	// Without a UsageStore limited LSATs are rejected
+	lsatmiddleware.UsageStore = nil
+	handler = ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/protected", limited))
+}
+
+func TestRepeatedCaveatsNarrow(t *testing.T) {
+	conditions := []caveat.Caveat{caveat.NewCaveat("article", "1")}
+	assert.True(t, caveat.CheckIfConditionsMatchCaveats([]caveat.Caveat{
+		caveat.NewCaveat("article", "1"),
+		caveat.NewCaveat("article", "1"),
+	}, conditions))
+	assert.False(t, caveat.CheckIfConditionsMatchCaveats([]caveat.Caveat{
+		caveat.NewCaveat("article", "2"),
+		caveat.NewCaveat("article", "1"),
+	}, conditions))
+	assert.False(t, caveat.CheckIfConditionsMatchCaveats([]caveat.Caveat{
+		caveat.NewCaveat("article", "1"),
+		caveat.NewCaveat("article", "2"),
+	}, conditions))
+}
@@ -0,0 +1,113 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/echolsat"
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/lsat"
+	"github.com/getAlby/lsat-middleware/middleware"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestPrepaidBalance(t *testing.T) {
+	ledger := middleware.NewMemoryLedger()
+	lnClient := &MockLNClient{UniquePreimages: true}
+	// 3 requests of 10 sats each
+	handler := strictLsatHandler(lnClient, withLedger(ledger, 30000), withUsageStore())
+
+	authorization, challenge := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	assert.Equal(t, int64(30), challenge.Get("amount").Int())
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", authorization))
+	}
+	balance, err := ledger.Balance(context.Background(), tokenId(t, authorization))
+	assert.NoError(t, err)
+	assert.Zero(t, balance)
+
+	topUp, challenge := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected").
+		SetHeader(gofight.H{"Authorization": authorization}))
+	assert.True(t, challenge.Get("top_up").Bool())
+	assert.Equal(t, tokenId(t, authorization), tokenId(t, topUp))
+
+	// The top-up is paid with its own preimage and spends the shared balance
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", topUp))
+	}
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/protected", topUp))
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/protected", authorization))
+}
+
+func TestPrepaidBalanceUses(t *testing.T) {
+	ledger := middleware.NewMemoryLedger()
+	lnClient := &MockLNClient{UniquePreimages: true}
+	handler := strictLsatHandler(lnClient, withLedger(ledger, 30000), withUsageStore())
+
+	authorization, _ := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	limited, err := lsat.Attenuate(authorization, []caveat.Caveat{caveat.MaxUses(2)})
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", authorization))
+	}
+
+	// Requests rejected for the balance don't count as uses
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/protected", limited))
+	_, err = ledger.Credit(context.Background(), tokenId(t, authorization), lntypes.Hash{1}, 30000)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", limited))
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", limited))
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/protected", limited))
+}
+
+func TestMemoryLedger(t *testing.T) {
+	ctx := context.Background()
+	ledger := middleware.NewMemoryLedger()
+	tokenId := [32]byte{1}
+	paymentHash := lntypes.Hash{2}
+
+	balance, err := ledger.Credit(ctx, tokenId, paymentHash, 5000)
+	assert.NoError(t, err)
+	assert.Equal(t, 5000, int(balance))
+	// A payment is only credited once
+	balance, err = ledger.Credit(ctx, tokenId, paymentHash, 5000)
+	assert.NoError(t, err)
+	assert.Equal(t, 5000, int(balance))
+
+	balance, err = ledger.Debit(ctx, tokenId, 2000)
+	assert.NoError(t, err)
+	assert.Equal(t, 3000, int(balance))
+	balance, err = ledger.Debit(ctx, tokenId, 4000)
+	assert.ErrorIs(t, err, lsat.ErrInsufficientBalance)
+	assert.Equal(t, 3000, int(balance))
+}
+
+func TestPrepaidBalanceHandler(t *testing.T) {
+	lnClient := &MockLNClient{UniquePreimages: true}
+	lsatmiddleware := mockLsatMiddleware(lnClient, withLedger(middleware.NewMemoryLedger(), 10000))
+	handlers := map[string]http.Handler{
+		"gin":  ginLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware}),
+		"echo": echoLsatHandler(&echolsat.EchoLsat{Middleware: *lsatmiddleware}),
+	}
+	acceptLsat := gofight.H{lsat.LSAT_HEADER_NAME: lsat.LSAT_HEADER}
+	for name, handler := range handlers {
+		authorization, _ := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected").SetHeader(acceptLsat))
+		assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", authorization), name)
+
+		// Clients supporting LSAT are offered a top-up, others get the error
+		gofight.New().GET("/protected").
+			SetHeader(gofight.H{"Authorization": authorization, lsat.LSAT_HEADER_NAME: lsat.LSAT_HEADER}).
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusPaymentRequired, res.Code, name)
+				assert.True(t, gjson.Get(res.Body.String(), "top_up").Bool(), name)
+			})
+		assert.Equal(t, http.StatusInternalServerError, requestStatus(handler, "/protected", authorization), name)
+	}
+}
@@ -2,11 +2,31 @@ package caveat
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/macaroon.v2"
 )
 
+// VALID_UNTIL is the condition of the caveat holding the unix timestamp
+// after which an LSAT is no longer accepted.
+const VALID_UNTIL = "valid_until"
+
+// MAX_USES is the condition of the caveat limiting how many requests an
+// LSAT may be presented with.
+const MAX_USES = "max_uses"
+
+// PLAN is the condition of the caveat naming the subscription plan of an
+// LSAT, minted right after the valid_until caveat renewals extend.
+// Renewal LSATs carry RENEWS with the plan name and RENEWS_FROM with the
+// unix timestamp the renewed period starts from.
+const (
+	PLAN        = "plan"
+	RENEWS      = "renews"
+	RENEWS_FROM = "renews_from"
+)
+
 type Caveat struct {
 	Condition string
 	Value     string
@@ -16,8 +36,10 @@ func EncodeCaveat(caveat Caveat) string {
 	return fmt.Sprintf("%s=%s", caveat.Condition, caveat.Value)
 }
 
+// DecodeCaveat splits at the first '=', so values may contain '=' but
+// conditions can't.
 func DecodeCaveat(caveatString string) (Caveat, error) {
-	splitted := strings.Split(caveatString, "=")
+	splitted := strings.SplitN(caveatString, "=", 2)
 	if len(splitted) != 2 {
 		return Caveat{}, fmt.Errorf("LSAT does not have the right format: %s", caveatString)
 	}
@@ -28,6 +50,14 @@ func NewCaveat(condition string, value string) Caveat {
 	return Caveat{Condition: condition, Value: value}
 }
 
+func ValidUntil(t time.Time) Caveat {
+	return NewCaveat(VALID_UNTIL, strconv.FormatInt(t.Unix(), 10))
+}
+
+func MaxUses(uses int64) Caveat {
+	return NewCaveat(MAX_USES, strconv.FormatInt(uses, 10))
+}
+
 func AddFirstPartyCaveats(mac *macaroon.Macaroon, caveats []Caveat) error {
 	for _, c := range caveats {
 		rawCaveat := []byte(EncodeCaveat(c))
@@ -38,7 +68,7 @@ func AddFirstPartyCaveats(mac *macaroon.Macaroon, caveats []Caveat) error {
 	return nil
 }
 
-func VerifyCaveats(rawCaveats []string, conditions []Caveat) error {
+func DecodeCaveats(rawCaveats []string) []Caveat {
 	caveats := make([]Caveat, 0, len(rawCaveats))
 	for _, rawCaveat := range rawCaveats {
 		caveat, err := DecodeCaveat(rawCaveat)
@@ -48,6 +78,11 @@ func VerifyCaveats(rawCaveats []string, conditions []Caveat) error {
 		}
 		caveats = append(caveats, caveat)
 	}
+	return caveats
+}
+
+func VerifyCaveats(rawCaveats []string, conditions []Caveat) error {
+	caveats := DecodeCaveats(rawCaveats)
 	if !CheckIfConditionsMatchCaveats(caveats, conditions) {
 		return fmt.Errorf("Caveats don't match")
 	}
@@ -60,15 +95,21 @@ func CheckIfConditionsMatchCaveats(caveats []Caveat, conditions []Caveat) bool {
 	if len(caveats) < len(conditions) {
 		return false
 	}
-	caveatsExist := make(map[string]Caveat, len(caveats))
-	for _, caveat := range caveats {
-		caveatsExist[caveat.Condition] = caveat
-	}
+	// Holders can add caveats but not remove them, so every caveat of a
+	// required condition has to match. Otherwise a repeated caveat could
+	// replace the value the LSAT was minted with.
 	for _, condition := range conditions {
-		if _, ok := caveatsExist[condition.Condition]; !ok {
-			return false
+		found := false
+		for _, caveat := range caveats {
+			if caveat.Condition != condition.Condition {
+				continue
+			}
+			if caveat.Value != condition.Value {
+				return false
+			}
+			found = true
 		}
-		if caveatsExist[condition.Condition].Value != condition.Value {
+		if !found {
 			return false
 		}
 	}
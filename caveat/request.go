@@ -0,0 +1,231 @@
+package caveat
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	PATH_PREFIX        = "path_prefix"
+	METHODS            = "methods"
+	HOST               = "host"
+	CLIENT_CIDR        = "client_cidr"
+	QUERY_PARAM_PREFIX = "query_"
+	HEADER_PREFIX      = "header_"
+)
+
+// RequestCaveat restricts an LSAT to requests like the one it was minted
+// for. Value computes the caveat when minting and Satisfied checks every
+// caveat with Condition against the request being verified, so caveats
+// repeated by the holder can only narrow access.
+type RequestCaveat struct {
+	Condition string
+	Value     func(req *http.Request) (string, error)
+	Satisfied func(value string, req *http.Request) bool
+}
+
+// Mint computes the caveats of requestCaveats for req.
+func Mint(requestCaveats []RequestCaveat, req *http.Request) ([]Caveat, error) {
+	caveats := make([]Caveat, 0, len(requestCaveats))
+	for _, requestCaveat := range requestCaveats {
+		value, err := requestCaveat.Value(req)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to mint %s caveat: %s", requestCaveat.Condition, err.Error())
+		}
+		caveats = append(caveats, NewCaveat(requestCaveat.Condition, value))
+	}
+	return caveats, nil
+}
+
+// Satisfy checks caveats against req with the RequestCaveat of their
+// condition. Conditions of the builders in this file are checked even if
+// missing from requestCaveats, as holders may add them when attenuating an
+// LSAT. Caveats of other conditions are left to VerifyCaveats.
+func Satisfy(caveats []Caveat, requestCaveats []RequestCaveat, req *http.Request) error {
+	for _, c := range caveats {
+		configured := false
+		for _, requestCaveat := range requestCaveats {
+			if c.Condition != requestCaveat.Condition {
+				continue
+			}
+			configured = true
+			if !requestCaveat.Satisfied(c.Value, req) {
+				return fmt.Errorf("Request does not satisfy caveat %s", EncodeCaveat(c))
+			}
+		}
+		if configured {
+			continue
+		}
+		if requestCaveat, ok := builtinRequestCaveat(c.Condition); ok && !requestCaveat.Satisfied(c.Value, req) {
+			return fmt.Errorf("Request does not satisfy caveat %s", EncodeCaveat(c))
+		}
+	}
+	return nil
+}
+
+func builtinRequestCaveat(condition string) (RequestCaveat, bool) {
+	switch {
+	case condition == PATH_PREFIX:
+		return PathPrefix(""), true
+	case condition == METHODS:
+		return Methods(), true
+	case condition == HOST:
+		return Host(), true
+	case condition == CLIENT_CIDR:
+		return ClientCIDR(32, 128, nil), true
+	case strings.HasPrefix(condition, QUERY_PARAM_PREFIX):
+		return QueryParam(strings.TrimPrefix(condition, QUERY_PARAM_PREFIX)), true
+	case strings.HasPrefix(condition, HEADER_PREFIX):
+		return Header(strings.TrimPrefix(condition, HEADER_PREFIX)), true
+	default:
+		return RequestCaveat{}, false
+	}
+}
+
+// PathPrefix restricts an LSAT to paths under prefix, matched by segment so
+// that /api doesn't cover /apis.
+func PathPrefix(prefix string) RequestCaveat {
+	return RequestCaveat{
+		Condition: PATH_PREFIX,
+		Value: func(req *http.Request) (string, error) {
+			if !hasPathPrefix(req.URL.Path, prefix) {
+				return "", fmt.Errorf("%s is not under %s", req.URL.Path, prefix)
+			}
+			return prefix, nil
+		},
+		Satisfied: func(value string, req *http.Request) bool {
+			return hasPathPrefix(req.URL.Path, value)
+		},
+	}
+}
+
+// Methods restricts an LSAT to the given HTTP methods.
+func Methods(methods ...string) RequestCaveat {
+	value := strings.ToUpper(strings.Join(methods, ","))
+	return RequestCaveat{
+		Condition: METHODS,
+		Value: func(req *http.Request) (string, error) {
+			if !containsMethod(value, req.Method) {
+				return "", fmt.Errorf("%s is not one of %s", req.Method, value)
+			}
+			return value, nil
+		},
+		Satisfied: func(value string, req *http.Request) bool {
+			return containsMethod(value, req.Method)
+		},
+	}
+}
+
+// Host restricts an LSAT to the host it was minted for.
+func Host() RequestCaveat {
+	return RequestCaveat{
+		Condition: HOST,
+		Value: func(req *http.Request) (string, error) {
+			return strings.ToLower(req.Host), nil
+		},
+		Satisfied: func(value string, req *http.Request) bool {
+			return strings.EqualFold(value, req.Host)
+		},
+	}
+}
+
+// QueryParam restricts an LSAT to the value the query parameter name had
+// when it was minted.
+func QueryParam(name string) RequestCaveat {
+	return RequestCaveat{
+		Condition: QUERY_PARAM_PREFIX + name,
+		Value: func(req *http.Request) (string, error) {
+			return req.URL.Query().Get(name), nil
+		},
+		Satisfied: func(value string, req *http.Request) bool {
+			return req.URL.Query().Get(name) == value
+		},
+	}
+}
+
+// Header restricts an LSAT to the value the header name had when it was
+// minted.
+func Header(name string) RequestCaveat {
+	return RequestCaveat{
+		Condition: HEADER_PREFIX + strings.ToLower(name),
+		Value: func(req *http.Request) (string, error) {
+			return req.Header.Get(name), nil
+		},
+		Satisfied: func(value string, req *http.Request) bool {
+			return req.Header.Get(name) == value
+		},
+	}
+}
+
+// ClientIP restricts an LSAT to the client address it was minted for.
+// clientIP defaults to RemoteClientIP, pass one that reads a trusted proxy
+// header when running behind a proxy.
+func ClientIP(clientIP func(req *http.Request) (netip.Addr, error)) RequestCaveat {
+	return ClientCIDR(32, 128, clientIP)
+}
+
+// ClientCIDR restricts an LSAT to the network of the client it was minted
+// for, e.g. the /24 for IPv4 and /64 for IPv6 clients.
+func ClientCIDR(ipv4Bits, ipv6Bits int, clientIP func(req *http.Request) (netip.Addr, error)) RequestCaveat {
+	if clientIP == nil {
+		clientIP = RemoteClientIP
+	}
+	return RequestCaveat{
+		Condition: CLIENT_CIDR,
+		Value: func(req *http.Request) (string, error) {
+			addr, err := clientIP(req)
+			if err != nil {
+				return "", err
+			}
+			bits := ipv6Bits
+			if addr.Is4() {
+				bits = ipv4Bits
+			}
+			prefix, err := addr.Prefix(bits)
+			if err != nil {
+				return "", err
+			}
+			return prefix.String(), nil
+		},
+		Satisfied: func(value string, req *http.Request) bool {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return false
+			}
+			addr, err := clientIP(req)
+			return err == nil && prefix.Contains(addr)
+		},
+	}
+}
+
+// RemoteClientIP is the address of the peer of req.
+func RemoteClientIP(req *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func containsMethod(methods, method string) bool {
+	for _, m := range strings.Split(methods, ",") {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package caveat
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+
+	"gopkg.in/macaroon.v2"
+)
+
+const THIRD_PARTY_ROOT_KEY_LENGTH = 32
+
+// ThirdPartyCaveat asks the discharger at Location to check Condition
+// before the LSAT is accepted. Key is shared with the discharger and
+// encrypts the caveat ID, it has to be 16, 24 or 32 bytes long.
+type ThirdPartyCaveat struct {
+	Location  string
+	Condition string
+	Key       []byte
+}
+
+// DischargeService issues discharge macaroons for third-party caveats, e.g.
+// a Discharger in-process or a client of a remote one.
+type DischargeService interface {
+	Discharge(ctx context.Context, location string, caveatId []byte) (*macaroon.Macaroon, error)
+}
+
+// AddThirdPartyCaveats adds thirdPartyCaveats to mac, each with a fresh
+// random root key that only the discharger can recover from the caveat ID.
+func AddThirdPartyCaveats(mac *macaroon.Macaroon, thirdPartyCaveats []ThirdPartyCaveat) error {
+	for _, c := range thirdPartyCaveats {
+		rootKey := make([]byte, THIRD_PARTY_ROOT_KEY_LENGTH)
+		if _, err := rand.Read(rootKey); err != nil {
+			return err
+		}
+		caveatId, err := encodeThirdPartyCaveatId(c.Key, rootKey, c.Condition)
+		if err != nil {
+			return err
+		}
+		if err := mac.AddThirdPartyCaveat(rootKey, caveatId, c.Location); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Discharger discharges the third-party caveats addressed to Location.
+type Discharger struct {
+	Location string
+	Key      []byte
+	// Check decides whether the condition of a caveat holds, an error
+	// refuses the discharge
+	Check func(ctx context.Context, condition string) error
+	// Caveats, if set, returns first-party caveats to add to the discharge,
+	// e.g. a short valid_until
+	Caveats func(condition string) []Caveat
+}
+
+func (discharger *Discharger) Discharge(ctx context.Context, location string, caveatId []byte) (*macaroon.Macaroon, error) {
+	if location != discharger.Location {
+		return nil, fmt.Errorf("No discharger for location %s", location)
+	}
+	rootKey, condition, err := decodeThirdPartyCaveatId(discharger.Key, caveatId)
+	if err != nil {
+		return nil, err
+	}
+	if discharger.Check != nil {
+		if err := discharger.Check(ctx, condition); err != nil {
+			return nil, fmt.Errorf("Caveat %s not discharged: %s", condition, err.Error())
+		}
+	}
+	discharge, err := macaroon.New(rootKey, caveatId, location, macaroon.LatestVersion)
+	if err != nil {
+		return nil, err
+	}
+	if discharger.Caveats != nil {
+		if err := AddFirstPartyCaveats(discharge, discharger.Caveats(condition)); err != nil {
+			return nil, err
+		}
+	}
+	return discharge, nil
+}
+
+// The caveat ID is the nonce followed by the sealed root key and condition.
+func encodeThirdPartyCaveatId(key []byte, rootKey []byte, condition string) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	plaintext := append(append([]byte{}, rootKey...), condition...)
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decodeThirdPartyCaveatId(key []byte, caveatId []byte) ([]byte, string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(caveatId) < aead.NonceSize() {
+		return nil, "", fmt.Errorf("Invalid third-party caveat ID")
+	}
+	nonce, sealed := caveatId[:aead.NonceSize()], caveatId[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil || len(plaintext) < THIRD_PARTY_ROOT_KEY_LENGTH {
+		return nil, "", fmt.Errorf("Invalid third-party caveat ID")
+	}
+	return plaintext[:THIRD_PARTY_ROOT_KEY_LENGTH], string(plaintext[THIRD_PARTY_ROOT_KEY_LENGTH:]), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid third-party caveat key: %s", err.Error())
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,63 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/getAlby/lsat-middleware/lsat"
+	"github.com/getAlby/lsat-middleware/middleware"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestLsatCookie(t *testing.T) {
+	for _, handler := range strictLsatHandlers(mockLsatMiddleware(&MockLNClient{}, withCookie())) {
+		router := gofight.New()
+
+		router.POST("/lsat/cookie").
+			SetHeader(gofight.H{
+				"Authorization": fmt.Sprintf("LSAT %s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_INVALID),
+			}).
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusUnauthorized, res.Code)
+				assert.Empty(t, res.HeaderMap.Get("Set-Cookie"))
+			})
+
+		router.POST("/lsat/cookie").
+			SetHeader(gofight.H{
+				"Authorization": fmt.Sprintf("LSAT %s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_VALID),
+			}).
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				cookies := (&http.Response{Header: res.HeaderMap}).Cookies()
+
+				assert.Equal(t, http.StatusNoContent, res.Code)
+				assert.Len(t, cookies, 1)
+				assert.Equal(t, middleware.DEFAULT_COOKIE_NAME, cookies[0].Name)
+				assert.Equal(t, fmt.Sprintf("%s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_VALID), cookies[0].Value)
+				assert.True(t, cookies[0].HttpOnly)
+				assert.True(t, cookies[0].Secure)
+			})
+
+		gofight.New().GET("/protected").
+			SetCookie(gofight.H{
+				middleware.DEFAULT_COOKIE_NAME: fmt.Sprintf("%s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_VALID),
+			}).
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				message := fmt.Sprint(gjson.Get(res.Body.String(), "message"))
+
+				assert.Equal(t, lsat.PROTECTED_CONTENT_MESSAGE, message)
+				assert.Equal(t, http.StatusAccepted, res.Code)
+			})
+
+		gofight.New().GET("/protected").
+			SetCookie(gofight.H{
+				middleware.DEFAULT_COOKIE_NAME: fmt.Sprintf("%s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_INVALID),
+			}).
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusPaymentRequired, res.Code)
+			})
+	}
+}
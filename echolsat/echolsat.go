@@ -1,18 +1,13 @@
 package echolsat
 
 import (
-	"context"
-	"fmt"
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/getAlby/lsat-middleware/caveat"
-	"github.com/getAlby/lsat-middleware/ln"
 	"github.com/getAlby/lsat-middleware/lsat"
-	macaroonutils "github.com/getAlby/lsat-middleware/macaroon"
 	"github.com/getAlby/lsat-middleware/middleware"
-	"github.com/getAlby/lsat-middleware/utils"
-	"github.com/lightningnetwork/lnd/lnrpc"
 
 	"github.com/labstack/echo/v4"
 )
@@ -23,85 +18,118 @@ type EchoLsat struct {
 
 func (lsatmiddleware *EchoLsat) Handler(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		//First check for presence of authorization header
-		authField := c.Request().Header.Get("Authorization")
-		caveats := []caveat.Caveat{}
-		if lsatmiddleware.Middleware.CaveatFunc != nil {
-			caveats = lsatmiddleware.Middleware.CaveatFunc(c.Request())
-		}
-		mac, preimage, err := utils.ParseLsatHeader(authField)
+		caveats, err := lsatmiddleware.Middleware.GetCaveats(c.Request())
 		if err != nil {
-			// No Authorization present, check if client supports LSAT
-
-			acceptLsatField := c.Request().Header.Get(lsat.LSAT_HEADER_NAME)
-
-			if strings.Contains(acceptLsatField, lsat.LSAT_HEADER) {
-				lsatmiddleware.SetLSATHeader(c, caveats)
-				return nil
-			}
-			// Set LSAT type Free if client does not support LSAT
-			c.Set("LSAT", &lsat.LsatInfo{
-				Type: lsat.LSAT_TYPE_FREE,
-			})
-			return next(c)
-		}
-		//LSAT Header is present, verify it
-		err = lsat.VerifyLSAT(mac, caveats, lsatmiddleware.Middleware.RootKey, preimage)
-		if err != nil {
-			//not a valid LSAT
 			c.Set("LSAT", &lsat.LsatInfo{
 				Type:  lsat.LSAT_TYPE_ERROR,
 				Error: err,
 			})
 			return next(c)
 		}
-		//LSAT verification ok, mark client as having paid
-		macaroonId, err := macaroonutils.GetMacIdFromMacaroon(mac)
+		lsatInfo := lsatmiddleware.Middleware.VerifyRequest(c.Request(), caveats)
+		acceptLsat := strings.Contains(c.Request().Header.Get(lsat.LSAT_HEADER_NAME), lsat.LSAT_HEADER)
+		if lsatInfo.Type == lsat.LSAT_TYPE_FREE || errors.Is(lsatInfo.Error, lsat.ErrMalformedToken) {
+			// No Authorization present, check if client supports LSAT
+			if acceptLsat && !lsatmiddleware.allowFree(c, lsatInfo) {
+				c.Set("LSAT", lsatInfo)
+				if err := lsatmiddleware.SetLSATHeader(c, caveats); err != nil {
+					// Let the handler report the error set by SetLSATHeader
+					return next(c)
+				}
+				return nil
+			}
+			// Serve for free if client does not support LSAT or has free requests left
+			lsatInfo = lsatmiddleware.Middleware.MarkFree(c.Request())
+		} else if acceptLsat && middleware.Upgradable(lsatInfo) {
+			// Offer clients supporting LSAT to upgrade or top up their LSAT
+			c.Set("LSAT", lsatInfo)
+			if err := lsatmiddleware.SetLSATHeader(c, caveats); err != nil {
+				return next(c)
+			}
+			return nil
+		}
+		c.Set("LSAT", lsatInfo)
+		return next(c)
+	}
+}
+
+// StrictHandler only lets paid requests through. Requests without a valid
+// LSAT get a 402 challenge and requests with a malformed one a 401.
+func (lsatmiddleware *EchoLsat) StrictHandler(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		caveats, err := lsatmiddleware.Middleware.GetCaveats(c.Request())
 		if err != nil {
-			c.Set("LSAT", &lsat.LsatInfo{
-				Type:  lsat.LSAT_TYPE_ERROR,
-				Error: err,
-			})
+			return lsatmiddleware.renderError(c, middleware.ChallengeErrorStatus(err), err)
+		}
+		lsatInfo := lsatmiddleware.Middleware.VerifyRequest(c.Request(), caveats)
+		c.Set("LSAT", lsatInfo)
+		if lsatInfo.Type == lsat.LSAT_TYPE_PAID {
 			return next(c)
 		}
-		c.Set("LSAT", &lsat.LsatInfo{
-			Type:        lsat.LSAT_TYPE_PAID,
-			Preimage:    preimage,
-			PaymentHash: macaroonId.PaymentHash,
-		})
-		return next(c)
+		if errors.Is(lsatInfo.Error, lsat.ErrMalformedToken) {
+			return lsatmiddleware.renderError(c, http.StatusUnauthorized, lsatInfo.Error)
+		}
+		if lsatmiddleware.allowFree(c, lsatInfo) {
+			c.Set("LSAT", lsatmiddleware.Middleware.MarkFree(c.Request()))
+			return next(c)
+		}
+		if err := lsatmiddleware.SetLSATHeader(c, caveats); err != nil {
+			return lsatmiddleware.renderError(c, middleware.ChallengeErrorStatus(err), err)
+		}
+		return nil
 	}
 }
 
-func (lsatmiddleware *EchoLsat) SetLSATHeader(c echo.Context, caveats []caveat.Caveat) {
+func (lsatmiddleware *EchoLsat) SetLSATHeader(c echo.Context, caveats []caveat.Caveat) error {
 	// Generate invoice and token
-	ctx := context.Background()
-	lnInvoice := lnrpc.Invoice{
-		Value: lsatmiddleware.Middleware.AmountFunc(c.Echo().AcquireContext().Request()),
-		Memo:  "LSAT",
-	}
-	LNClientConn := &ln.LNClientConn{
-		LNClient: lsatmiddleware.Middleware.LNClient,
+	ctx := c.Request().Context()
+	lsatInfo, ok := c.Get("LSAT").(*lsat.LsatInfo)
+	if !ok {
+		lsatInfo = &lsat.LsatInfo{Type: lsat.LSAT_TYPE_FREE}
 	}
-	invoice, paymentHash, err := LNClientConn.GenerateInvoice(ctx, lnInvoice, c.Echo().AcquireContext().Request())
+	challenge, err := lsatmiddleware.Middleware.CreateChallenge(ctx, c.Request(), lsatInfo, caveats)
 	if err != nil {
 		c.Set("LSAT", &lsat.LsatInfo{
 			Type:  lsat.LSAT_TYPE_ERROR,
 			Error: err,
 		})
-		return
+		return err
 	}
-	macaroonString, err := macaroonutils.GetMacaroonAsString(paymentHash, caveats, lsatmiddleware.Middleware.RootKey)
-	if err != nil {
-		c.Set("LSAT", &lsat.LsatInfo{
-			Type:  lsat.LSAT_TYPE_ERROR,
-			Error: err,
-		})
-		return
-	}
-	c.Response().Header().Set("WWW-Authenticate", fmt.Sprintf("LSAT macaroon=%s, invoice=%s", macaroonString, invoice))
-	c.JSON(http.StatusPaymentRequired, map[string]interface{}{
-		"code":    http.StatusPaymentRequired,
-		"message": lsat.PAYMENT_REQUIRED_MESSAGE,
+	lsatmiddleware.Middleware.WriteChallenge(c.Response(), c.Request(), lsatInfo, challenge)
+	return nil
+}
+
+// allowFree reports whether a request without LSAT is let through on the
+// free quota instead of being challenged.
+func (lsatmiddleware *EchoLsat) allowFree(c echo.Context, lsatInfo *lsat.LsatInfo) bool {
+	return lsatInfo.Type == lsat.LSAT_TYPE_FREE && lsatmiddleware.Middleware.AllowFree(c.Response(), c.Request())
+}
+
+func (lsatmiddleware *EchoLsat) renderError(c echo.Context, status int, err error) error {
+	return lsatmiddleware.Middleware.Render(c.Response(), c.Request(), &middleware.Response{
+		Status:  status,
+		Message: err.Error(),
+		Error:   err,
 	})
 }
+
+// CookieHandler mounts LsatMiddleware.CookieHandler, e.g.
+// router.POST("/lsat/cookie", lsatmiddleware.CookieHandler)
+func (lsatmiddleware *EchoLsat) CookieHandler(c echo.Context) error {
+	lsatmiddleware.Middleware.CookieHandler(c.Response(), c.Request())
+	return nil
+}
+
+// StatusHandler mounts LsatMiddleware.StatusHandler, e.g.
+// router.GET("/lsat/status", lsatmiddleware.StatusHandler)
+func (lsatmiddleware *EchoLsat) StatusHandler(c echo.Context) error {
+	lsatmiddleware.Middleware.StatusHandler(c.Response(), c.Request())
+	return nil
+}
+
+// RenewalHandler mounts LsatMiddleware.RenewalHandler, e.g.
+// router.POST("/lsat/renew", lsatmiddleware.RenewalHandler)
+func (lsatmiddleware *EchoLsat) RenewalHandler(c echo.Context) error {
+	lsatmiddleware.Middleware.RenewalHandler(c.Response(), c.Request())
+	return nil
+}
@@ -7,12 +7,12 @@ import (
 	"strings"
 	"testing"
 
-	"github.com/getAlby/lsat-middleware/caveat"
 	"github.com/getAlby/lsat-middleware/echolsat"
 	"github.com/getAlby/lsat-middleware/ln"
 	"github.com/getAlby/lsat-middleware/lsat"
 	macaroonutils "github.com/getAlby/lsat-middleware/macaroon"
 	"github.com/getAlby/lsat-middleware/middleware"
+	"github.com/getAlby/lsat-middleware/rates"
 	"github.com/getAlby/lsat-middleware/utils"
 
 	"github.com/labstack/echo/v4"
@@ -75,11 +75,13 @@ func TestEchoLsatWithLNURLConfig(t *testing.T) {
 		},
 		RootKey: []byte(ROOT_KEY),
 	}
-	fr := &FiatRateConfig{
-		Currency: "USD",
-		Amount:   0.01,
+	fr := &rates.FiatAmount{
+		Provider:     fiatRateProvider,
+		Currency:     "USD",
+		Cents:        1,
+		FallbackSats: MIN_SATS_TO_BE_PAID,
 	}
-	lsatmiddleware, err := middleware.NewLsatMiddleware(lnClientConfig, fr.FiatToBTCAmountFunc, PathCaveat)
+	lsatmiddleware, err := middleware.NewLsatMiddleware(lnClientConfig, fr.AmountFunc, PathCaveat)
 	assert.NoError(t, err)
 
 	echolsatmiddleware := &echolsat.EchoLsat{
@@ -174,11 +176,13 @@ func TestEchoLsatWithLNDConfig(t *testing.T) {
 		},
 		RootKey: []byte(ROOT_KEY),
 	}
-	fr := &FiatRateConfig{
-		Currency: "USD",
-		Amount:   0.01,
+	fr := &rates.FiatAmount{
+		Provider:     fiatRateProvider,
+		Currency:     "USD",
+		Cents:        1,
+		FallbackSats: MIN_SATS_TO_BE_PAID,
 	}
-	lsatmiddleware, err := middleware.NewLsatMiddleware(lnClientConfig, fr.FiatToBTCAmountFunc, PathCaveat)
+	lsatmiddleware, err := middleware.NewLsatMiddleware(lnClientConfig, fr.AmountFunc, PathCaveat)
 	assert.NoError(t, err)
 
 	echolsatmiddleware := &echolsat.EchoLsat{
@@ -256,12 +260,3 @@ func TestEchoLsatWithLNDConfig(t *testing.T) {
 			assert.Equal(t, http.StatusInternalServerError, res.Code)
 		})
 }
-
-func PathCaveat(req *http.Request) []caveat.Caveat {
-	return []caveat.Caveat{
-		{
-			Condition: "RequestPath",
-			Value:     req.URL.Path,
-		},
-	}
-}
@@ -2,52 +2,20 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
 
 	"github.com/getAlby/lsat-middleware/echolsat"
 	"github.com/getAlby/lsat-middleware/ln"
 	"github.com/getAlby/lsat-middleware/lsat"
 	"github.com/getAlby/lsat-middleware/middleware"
+	"github.com/getAlby/lsat-middleware/rates"
 
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 )
 
-const SATS_PER_BTC = 100000000
-
-const MIN_SATS_TO_BE_PAID = 1
-
-type FiatRateConfig struct {
-	Currency string
-	Amount   float64
-}
-
-func (fr *FiatRateConfig) FiatToBTCAmountFunc(req *http.Request) (amount int64) {
-	if req == nil {
-		return MIN_SATS_TO_BE_PAID
-	}
-	res, err := http.Get(fmt.Sprintf("https://blockchain.info/tobtc?currency=%s&value=%f", fr.Currency, fr.Amount))
-	if err != nil {
-		return MIN_SATS_TO_BE_PAID
-	}
-	defer res.Body.Close()
-
-	amountBits, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return MIN_SATS_TO_BE_PAID
-	}
-	amountInBTC, err := strconv.ParseFloat(string(amountBits), 32)
-	if err != nil {
-		return MIN_SATS_TO_BE_PAID
-	}
-	amountInSats := SATS_PER_BTC * amountInBTC
-	return int64(amountInSats)
-}
-
 func main() {
 	router := echo.New()
 
@@ -73,14 +41,25 @@ func main() {
 		},
 		RootKey: []byte(os.Getenv("ROOT_KEY")),
 	}
-	fr := &FiatRateConfig{
+	fr := &rates.FiatAmount{
+		Provider: &rates.CachedProvider{
+			Provider: &rates.MedianProvider{
+				Providers: []rates.RateProvider{
+					&rates.BlockchainInfoProvider{},
+					&rates.CoinbaseProvider{},
+				},
+			},
+		},
 		Currency: "USD",
-		Amount:   0.01,
+		Cents:    1,
 	}
-	lsatmiddleware, err := middleware.NewLsatMiddleware(lnClientConfig, fr.FiatToBTCAmountFunc, nil)
+	lsatmiddleware, err := middleware.NewLsatMiddleware(lnClientConfig, nil, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Requests are rejected while no rate is available, instead of being
+	// charged a made up price
+	lsatmiddleware.AmountMsatFunc = fr.AmountMsat
 	echolsatmiddleware := &echolsat.EchoLsat{
 		Middleware: *lsatmiddleware,
 	}
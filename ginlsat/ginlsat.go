@@ -1,18 +1,13 @@
 package ginlsat
 
 import (
-	"context"
-	"fmt"
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/getAlby/lsat-middleware/caveat"
-	"github.com/getAlby/lsat-middleware/ln"
 	"github.com/getAlby/lsat-middleware/lsat"
-	macaroonutils "github.com/getAlby/lsat-middleware/macaroon"
 	"github.com/getAlby/lsat-middleware/middleware"
-	"github.com/getAlby/lsat-middleware/utils"
-	"github.com/lightningnetwork/lnd/lnrpc"
 
 	"github.com/gin-gonic/gin"
 )
@@ -22,82 +17,109 @@ type GinLsat struct {
 }
 
 func (lsatmiddleware *GinLsat) Handler(c *gin.Context) {
-	//First check for presence of authorization header
-	authField := c.Request.Header.Get("Authorization")
-	mac, preimage, err := utils.ParseLsatHeader(authField)
-	caveats := []caveat.Caveat{}
-	if lsatmiddleware.Middleware.CaveatFunc != nil {
-		caveats = lsatmiddleware.Middleware.CaveatFunc(c.Request)
-	}
+	caveats, err := lsatmiddleware.Middleware.GetCaveats(c.Request)
 	if err != nil {
+		c.Set("LSAT", &lsat.LsatInfo{
+			Type:  lsat.LSAT_TYPE_ERROR,
+			Error: err,
+		})
+		return
+	}
+	lsatInfo := lsatmiddleware.Middleware.VerifyRequest(c.Request, caveats)
+	acceptLsat := strings.Contains(c.Request.Header.Get(lsat.LSAT_HEADER_NAME), lsat.LSAT_HEADER)
+	if lsatInfo.Type == lsat.LSAT_TYPE_FREE || errors.Is(lsatInfo.Error, lsat.ErrMalformedToken) {
 		// No Authorization present, check if client supports LSAT
-		acceptLsatField := c.Request.Header.Get(lsat.LSAT_HEADER_NAME)
-		if strings.Contains(acceptLsatField, lsat.LSAT_HEADER) {
+		if acceptLsat && !lsatmiddleware.allowFree(c, lsatInfo) {
+			c.Set("LSAT", lsatInfo)
 			lsatmiddleware.SetLSATHeader(c, caveats)
 			return
 		}
-		// Set LSAT type Free if client does not support LSAT
-		c.Set("LSAT", &lsat.LsatInfo{
-			Type: lsat.LSAT_TYPE_FREE,
-		})
+		// Serve for free if client does not support LSAT or has free requests left
+		lsatInfo = lsatmiddleware.Middleware.MarkFree(c.Request)
+	} else if acceptLsat && middleware.Upgradable(lsatInfo) {
+		// Offer clients supporting LSAT to upgrade or top up their LSAT
+		c.Set("LSAT", lsatInfo)
+		lsatmiddleware.SetLSATHeader(c, caveats)
 		return
 	}
-	//LSAT Header is present, verify it
-	err = lsat.VerifyLSAT(mac, caveats, lsatmiddleware.Middleware.RootKey, preimage)
+	c.Set("LSAT", lsatInfo)
+}
+
+// StrictHandler only lets paid requests through. Requests without a valid
+// LSAT get a 402 challenge and requests with a malformed one a 401.
+func (lsatmiddleware *GinLsat) StrictHandler(c *gin.Context) {
+	caveats, err := lsatmiddleware.Middleware.GetCaveats(c.Request)
 	if err != nil {
-		//not a valid LSAT
-		c.Set("LSAT", &lsat.LsatInfo{
-			Type:  lsat.LSAT_TYPE_ERROR,
-			Error: err,
-		})
+		lsatmiddleware.renderError(c, middleware.ChallengeErrorStatus(err), err)
 		return
 	}
-	//LSAT verification ok, mark client as having paid
-	macaroonId, err := macaroonutils.GetMacIdFromMacaroon(mac)
-	if err != nil {
-		c.Set("LSAT", &lsat.LsatInfo{
-			Type:  lsat.LSAT_TYPE_ERROR,
-			Error: err,
-		})
+	lsatInfo := lsatmiddleware.Middleware.VerifyRequest(c.Request, caveats)
+	c.Set("LSAT", lsatInfo)
+	if lsatInfo.Type == lsat.LSAT_TYPE_PAID {
 		return
 	}
-	c.Set("LSAT", &lsat.LsatInfo{
-		Type:        lsat.LSAT_TYPE_PAID,
-		Preimage:    preimage,
-		PaymentHash: macaroonId.PaymentHash,
-	})
-
+	if errors.Is(lsatInfo.Error, lsat.ErrMalformedToken) {
+		lsatmiddleware.renderError(c, http.StatusUnauthorized, lsatInfo.Error)
+		return
+	}
+	if lsatmiddleware.allowFree(c, lsatInfo) {
+		c.Set("LSAT", lsatmiddleware.Middleware.MarkFree(c.Request))
+		return
+	}
+	if err := lsatmiddleware.SetLSATHeader(c, caveats); err != nil {
+		lsatmiddleware.renderError(c, middleware.ChallengeErrorStatus(err), err)
+	}
 }
 
-func (lsatmiddleware *GinLsat) SetLSATHeader(c *gin.Context, caveats []caveat.Caveat) {
+func (lsatmiddleware *GinLsat) SetLSATHeader(c *gin.Context, caveats []caveat.Caveat) error {
 	// Generate invoice and token
-	ctx := context.Background()
-	lnInvoice := lnrpc.Invoice{
-		Value: lsatmiddleware.Middleware.AmountFunc(c.Request),
-		Memo:  "LSAT",
-	}
-	LNClientConn := &ln.LNClientConn{
-		LNClient: lsatmiddleware.Middleware.LNClient,
+	ctx := c.Request.Context()
+	lsatInfo, ok := c.Value("LSAT").(*lsat.LsatInfo)
+	if !ok {
+		lsatInfo = &lsat.LsatInfo{Type: lsat.LSAT_TYPE_FREE}
 	}
-	invoice, paymentHash, err := LNClientConn.GenerateInvoice(ctx, lnInvoice, c.Request)
+	challenge, err := lsatmiddleware.Middleware.CreateChallenge(ctx, c.Request, lsatInfo, caveats)
 	if err != nil {
 		c.Set("LSAT", &lsat.LsatInfo{
 			Type:  lsat.LSAT_TYPE_ERROR,
 			Error: err,
 		})
-		return
+		return err
 	}
-	macaroonString, err := macaroonutils.GetMacaroonAsString(paymentHash, caveats, lsatmiddleware.Middleware.RootKey)
-	if err != nil {
-		c.Set("LSAT", &lsat.LsatInfo{
-			Type:  lsat.LSAT_TYPE_ERROR,
-			Error: err,
-		})
-		return
-	}
-	c.Writer.Header().Set("WWW-Authenticate", fmt.Sprintf("LSAT macaroon=%s, invoice=%s", macaroonString, invoice))
-	c.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{
-		"code":    http.StatusPaymentRequired,
-		"message": lsat.PAYMENT_REQUIRED_MESSAGE,
+	c.Abort()
+	lsatmiddleware.Middleware.WriteChallenge(c.Writer, c.Request, lsatInfo, challenge)
+	return nil
+}
+
+// allowFree reports whether a request without LSAT is let through on the
+// free quota instead of being challenged.
+func (lsatmiddleware *GinLsat) allowFree(c *gin.Context, lsatInfo *lsat.LsatInfo) bool {
+	return lsatInfo.Type == lsat.LSAT_TYPE_FREE && lsatmiddleware.Middleware.AllowFree(c.Writer, c.Request)
+}
+
+func (lsatmiddleware *GinLsat) renderError(c *gin.Context, status int, err error) {
+	c.Abort()
+	lsatmiddleware.Middleware.Render(c.Writer, c.Request, &middleware.Response{
+		Status:  status,
+		Message: err.Error(),
+		Error:   err,
 	})
 }
+
+// CookieHandler mounts LsatMiddleware.CookieHandler, e.g.
+// router.POST("/lsat/cookie", lsatmiddleware.CookieHandler)
+func (lsatmiddleware *GinLsat) CookieHandler(c *gin.Context) {
+	lsatmiddleware.Middleware.CookieHandler(c.Writer, c.Request)
+}
+
+// StatusHandler mounts LsatMiddleware.StatusHandler, e.g.
+// router.GET("/lsat/status", lsatmiddleware.StatusHandler)
+func (lsatmiddleware *GinLsat) StatusHandler(c *gin.Context) {
+	lsatmiddleware.Middleware.StatusHandler(c.Writer, c.Request)
+}
+
+// RenewalHandler mounts LsatMiddleware.RenewalHandler, e.g.
+// router.POST("/lsat/renew", lsatmiddleware.RenewalHandler)
+func (lsatmiddleware *GinLsat) RenewalHandler(c *gin.Context) {
+	lsatmiddleware.Middleware.RenewalHandler(c.Writer, c.Request)
+}
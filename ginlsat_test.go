@@ -12,6 +12,7 @@ import (
 	"github.com/getAlby/lsat-middleware/lsat"
 	macaroonutils "github.com/getAlby/lsat-middleware/macaroon"
 	"github.com/getAlby/lsat-middleware/middleware"
+	"github.com/getAlby/lsat-middleware/rates"
 	"github.com/getAlby/lsat-middleware/utils"
 
 	"github.com/appleboy/gofight/v2"
@@ -70,11 +71,13 @@ func TestGinLsatWithLNURLConfig(t *testing.T) {
 		},
 		RootKey: []byte(ROOT_KEY),
 	}
-	fr := &FiatRateConfig{
-		Currency: "USD",
-		Amount:   0.01,
+	fr := &rates.FiatAmount{
+		Provider:     fiatRateProvider,
+		Currency:     "USD",
+		Cents:        1,
+		FallbackSats: MIN_SATS_TO_BE_PAID,
 	}
-	lsatmiddleware, err := middleware.NewLsatMiddleware(lnClientConfig, fr.FiatToBTCAmountFunc, PathCaveat)
+	lsatmiddleware, err := middleware.NewLsatMiddleware(lnClientConfig, fr.AmountFunc, PathCaveat)
 	assert.NoError(t, err)
 
 	ginlsatmiddleware := &ginlsat.GinLsat{
@@ -167,11 +170,13 @@ func TestGinLsatWithLNDConfig(t *testing.T) {
 		},
 		RootKey: []byte(ROOT_KEY),
 	}
-	fr := &FiatRateConfig{
-		Currency: "USD",
-		Amount:   0.01,
+	fr := &rates.FiatAmount{
+		Provider:     fiatRateProvider,
+		Currency:     "USD",
+		Cents:        1,
+		FallbackSats: MIN_SATS_TO_BE_PAID,
 	}
-	lsatmiddleware, err := middleware.NewLsatMiddleware(lnClientConfig, fr.FiatToBTCAmountFunc, PathCaveat)
+	lsatmiddleware, err := middleware.NewLsatMiddleware(lnClientConfig, fr.AmountFunc, PathCaveat)
 	assert.NoError(t, err)
 
 	ginlsatmiddleware := &ginlsat.GinLsat{
@@ -0,0 +1,64 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/getAlby/lsat-middleware/echolsat"
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/lsat"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func runHookTests(t *testing.T, handler http.Handler, calls *[]string) {
+	gofight.New().GET("/protected").
+		SetHeader(gofight.H{
+			lsat.LSAT_HEADER_NAME: lsat.LSAT_HEADER,
+		}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPaymentRequired, res.Code)
+		})
+	assert.Equal(t, []string{"invoice FREE", "challenge FREE"}, *calls)
+
+	*calls = nil
+	gofight.New().GET("/protected").
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusAccepted, res.Code)
+		})
+	assert.Equal(t, []string{"free FREE"}, *calls)
+
+	*calls = nil
+	gofight.New().GET("/protected").
+		SetHeader(gofight.H{
+			"Authorization": fmt.Sprintf("LSAT %s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_VALID),
+		}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusAccepted, res.Code)
+		})
+	assert.Equal(t, []string{"verified PAID"}, *calls)
+
+	*calls = nil
+	gofight.New().GET("/protected").
+		SetHeader(gofight.H{
+			"Authorization": fmt.Sprintf("LSAT %s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_INVALID),
+		}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusInternalServerError, res.Code)
+		})
+	assert.Equal(t, []string{"rejected ERROR"}, *calls)
+}
+
+func TestGinLsatHooks(t *testing.T) {
+	calls := []string{}
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{}, withHooks(&calls))
+	runHookTests(t, ginLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware}), &calls)
+}
+
+func TestEchoLsatHooks(t *testing.T) {
+	calls := []string{}
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{}, withHooks(&calls))
+	runHookTests(t, echoLsatHandler(&echolsat.EchoLsat{Middleware: *lsatmiddleware}), &calls)
+}
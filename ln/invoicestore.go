@@ -0,0 +1,128 @@
+package ln
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+var ErrInvoiceNotFound = errors.New("Invoice not found")
+
+// InvoiceState is the last known state of an invoice, as recorded from the
+// invoice subscription of the LN node.
+type InvoiceState struct {
+	PaymentHash    lntypes.Hash
+	Memo           string
+	State          lnrpc.Invoice_InvoiceState
+	Preimage       lntypes.Preimage
+	ValueMsat      int64
+	AmountPaidMsat int64
+	AddIndex       uint64
+	SettleIndex    uint64
+	CreatedAt      time.Time
+	ExpiresAt      time.Time
+	SettledAt      time.Time
+}
+
+func (invoiceState *InvoiceState) IsSettled() bool {
+	return invoiceState.State == lnrpc.Invoice_SETTLED
+}
+
+// InvoiceStore records invoice states. Implementations must be safe for
+// concurrent use.
+type InvoiceStore interface {
+	PutInvoice(ctx context.Context, invoiceState *InvoiceState) error
+	// GetInvoice returns ErrInvoiceNotFound for unknown payment hashes
+	GetInvoice(ctx context.Context, paymentHash lntypes.Hash) (*InvoiceState, error)
+	// LastIndexes returns the highest add and settle index stored, which
+	// the subscription resumes from.
+	LastIndexes(ctx context.Context) (addIndex uint64, settleIndex uint64, err error)
+}
+
+// MemoryInvoiceStore keeps invoice states in memory. Use Prune to drop old
+// invoices in long running processes.
+type MemoryInvoiceStore struct {
+	mu          sync.RWMutex
+	invoices    map[lntypes.Hash]*InvoiceState
+	addIndex    uint64
+	settleIndex uint64
+}
+
+func NewMemoryInvoiceStore() *MemoryInvoiceStore {
+	return &MemoryInvoiceStore{
+		invoices: make(map[lntypes.Hash]*InvoiceState),
+	}
+}
+
+func (store *MemoryInvoiceStore) PutInvoice(ctx context.Context, invoiceState *InvoiceState) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	stored := *invoiceState
+	store.invoices[invoiceState.PaymentHash] = &stored
+	if invoiceState.AddIndex > store.addIndex {
+		store.addIndex = invoiceState.AddIndex
+	}
+	if invoiceState.SettleIndex > store.settleIndex {
+		store.settleIndex = invoiceState.SettleIndex
+	}
+	return nil
+}
+
+func (store *MemoryInvoiceStore) GetInvoice(ctx context.Context, paymentHash lntypes.Hash) (*InvoiceState, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	invoiceState, ok := store.invoices[paymentHash]
+	if !ok {
+		return nil, ErrInvoiceNotFound
+	}
+	stored := *invoiceState
+	return &stored, nil
+}
+
+func (store *MemoryInvoiceStore) LastIndexes(ctx context.Context) (uint64, uint64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.addIndex, store.settleIndex, nil
+}
+
+// Prune drops the invoices created before the given time.
+func (store *MemoryInvoiceStore) Prune(before time.Time) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for paymentHash, invoiceState := range store.invoices {
+		if invoiceState.CreatedAt.Before(before) {
+			delete(store.invoices, paymentHash)
+		}
+	}
+}
+
+func NewInvoiceState(invoice *lnrpc.Invoice) (*InvoiceState, error) {
+	paymentHash, err := lntypes.MakeHash(invoice.RHash)
+	if err != nil {
+		return nil, err
+	}
+	invoiceState := &InvoiceState{
+		PaymentHash:    paymentHash,
+		Memo:           invoice.Memo,
+		State:          invoice.State,
+		ValueMsat:      invoice.ValueMsat,
+		AmountPaidMsat: invoice.AmtPaidMsat,
+		AddIndex:       invoice.AddIndex,
+		SettleIndex:    invoice.SettleIndex,
+		CreatedAt:      time.Unix(invoice.CreationDate, 0),
+		ExpiresAt:      time.Unix(invoice.CreationDate+invoice.Expiry, 0),
+	}
+	if invoice.State == lnrpc.Invoice_SETTLED {
+		preimage, err := lntypes.MakePreimage(invoice.RPreimage)
+		if err != nil {
+			return nil, err
+		}
+		invoiceState.Preimage = preimage
+		invoiceState.SettledAt = time.Unix(invoice.SettleDate, 0)
+	}
+	return invoiceState, nil
+}
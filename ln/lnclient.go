@@ -2,11 +2,16 @@ package ln
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 
+	"github.com/getAlby/lsat-middleware/tracing"
+
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 )
 
@@ -15,6 +20,11 @@ const (
 	LNURL_CLIENT_TYPE = "LNURL"
 )
 
+var (
+	ErrInvoiceLookupUnsupported       = errors.New("LN client can't look up invoices")
+	ErrInvoiceSubscriptionUnsupported = errors.New("LN client can't subscribe to invoices")
+)
+
 type LNClientConfig struct {
 	LNClientType string
 	LNDConfig    LNDoptions
@@ -25,6 +35,12 @@ type LNClient interface {
 	AddInvoice(ctx context.Context, lnReq *lnrpc.Invoice, httpReq *http.Request, options ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error)
 }
 
+// InvoiceLookupClient is implemented by LN clients that can tell whether an
+// invoice they created has been paid.
+type InvoiceLookupClient interface {
+	LookupInvoice(ctx context.Context, paymentHash lntypes.Hash, options ...grpc.CallOption) (*lnrpc.Invoice, error)
+}
+
 type LNClientConn struct {
 	LNClient LNClient
 }
@@ -48,8 +64,36 @@ func InitLnClient(lnClientConfig *LNClientConfig) (lnClient LNClient, err error)
 	return lnClient, nil
 }
 
-func (lnClientConn *LNClientConn) GenerateInvoice(ctx context.Context, lnInvoice lnrpc.Invoice, httpReq *http.Request) (string, lntypes.Hash, error) {
-	lnClientInvoice, err := lnClientConn.LNClient.AddInvoice(ctx, &lnInvoice, httpReq)
+// ClientType names the backend of lnClient, LND_CLIENT_TYPE or
+// LNURL_CLIENT_TYPE for the clients in this package.
+func ClientType(lnClient LNClient) string {
+	switch lnClient.(type) {
+	case *LNDWrapper:
+		return LND_CLIENT_TYPE
+	case *LnAddressUrlResJson:
+		return LNURL_CLIENT_TYPE
+	default:
+		return fmt.Sprintf("%T", lnClient)
+	}
+}
+
+// InvoiceAmountMsat is the amount of lnInvoice, which sets either Value or ValueMsat.
+func InvoiceAmountMsat(lnInvoice *lnrpc.Invoice) lnwire.MilliSatoshi {
+	if lnInvoice.ValueMsat != 0 {
+		return lnwire.MilliSatoshi(lnInvoice.ValueMsat)
+	}
+	return lnwire.MilliSatoshi(lnInvoice.Value * MSAT_PER_SAT)
+}
+
+func startAddInvoiceSpan(ctx context.Context, backend string, lnInvoice *lnrpc.Invoice) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, backend+".AddInvoice", trace.WithAttributes(
+		tracing.ATTRIBUTE_BACKEND.String(backend),
+		tracing.ATTRIBUTE_AMOUNT_MSAT.Int64(int64(InvoiceAmountMsat(lnInvoice))),
+	))
+}
+
+func (lnClientConn *LNClientConn) GenerateInvoice(ctx context.Context, lnInvoice *lnrpc.Invoice, httpReq *http.Request) (string, lntypes.Hash, error) {
+	lnClientInvoice, err := lnClientConn.LNClient.AddInvoice(ctx, lnInvoice, httpReq)
 	if err != nil {
 		return "", lntypes.Hash{}, err
 	}
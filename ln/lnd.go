@@ -6,13 +6,21 @@ import (
 	"crypto/x509"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 
+	"github.com/getAlby/lsat-middleware/logging"
+	"github.com/getAlby/lsat-middleware/tracing"
+
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
 	"github.com/lightningnetwork/lnd/macaroons"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 	"gopkg.in/macaroon.v2"
 )
 
@@ -22,13 +30,31 @@ type LNDoptions struct {
 	CertHex      string
 	MacaroonFile string
 	MacaroonHex  string
+	// Logger receives initialization and backend errors, nothing is logged
+	// if nil. Credentials are never logged.
+	Logger *slog.Logger
 }
 
 type LNDWrapper struct {
 	client lnrpc.LightningClient
+	logger *slog.Logger
 }
 
-func NewLNDclient(lndOptions LNDoptions) (result *LNDWrapper, err error) {
+func NewLNDclient(lndOptions LNDoptions) (*LNDWrapper, error) {
+	logger := logging.Logger(lndOptions.Logger).With(slog.String("backend", LND_CLIENT_TYPE))
+	wrapper, err := newLNDclient(lndOptions)
+	if err != nil {
+		logger.Error("Failed to initialize LN client",
+			slog.String("address", lndOptions.Address),
+			slog.Any("error", err))
+		return nil, err
+	}
+	wrapper.logger = logger
+	logger.Info("LN client initialized", slog.String("address", lndOptions.Address))
+	return wrapper, nil
+}
+
+func newLNDclient(lndOptions LNDoptions) (result *LNDWrapper, err error) {
 	// Get credentials either from a hex string, a file or the system's certificate store
 	var creds credentials.TransportCredentials
 	// if a hex string is provided
@@ -92,5 +118,32 @@ func NewLNDclient(lndOptions LNDoptions) (result *LNDWrapper, err error) {
 }
 
 func (wrapper *LNDWrapper) AddInvoice(ctx context.Context, req *lnrpc.Invoice, httpReq *http.Request, options ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error) {
-	return wrapper.client.AddInvoice(ctx, req, options...)
+	ctx, span := startAddInvoiceSpan(ctx, LND_CLIENT_TYPE, req)
+	defer span.End()
+	res, err := wrapper.client.AddInvoice(ctx, req, options...)
+	if err != nil {
+		wrapper.log().ErrorContext(ctx, "AddInvoice failed", slog.Int64("amount_msat", int64(InvoiceAmountMsat(req))), slog.Any("error", err))
+	}
+	tracing.RecordError(span, err)
+	return res, err
+}
+
+func (wrapper *LNDWrapper) LookupInvoice(ctx context.Context, paymentHash lntypes.Hash, options ...grpc.CallOption) (*lnrpc.Invoice, error) {
+	invoice, err := wrapper.client.LookupInvoice(ctx, &lnrpc.PaymentHash{RHash: paymentHash[:]}, options...)
+	if status.Code(err) == codes.NotFound {
+		return nil, fmt.Errorf("%w: %s", ErrInvoiceNotFound, err.Error())
+	}
+	if err != nil {
+		wrapper.log().WarnContext(ctx, "LookupInvoice failed", slog.String("payment_hash", paymentHash.String()), slog.Any("error", err))
+	}
+	return invoice, err
+}
+
+// log falls back to discarding for wrappers not built by NewLNDclient
+func (wrapper *LNDWrapper) log() *slog.Logger {
+	return logging.Logger(wrapper.logger)
+}
+
+func (wrapper *LNDWrapper) SubscribeInvoices(ctx context.Context, req *lnrpc.InvoiceSubscription, options ...grpc.CallOption) (lnrpc.Lightning_SubscribeInvoicesClient, error) {
+	return wrapper.client.SubscribeInvoices(ctx, req, options...)
 }
@@ -5,8 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/getAlby/lsat-middleware/logging"
+	"github.com/getAlby/lsat-middleware/tracing"
 	"github.com/getAlby/lsat-middleware/utils"
 
 	decodepay "github.com/fiatjaf/ln-decodepay"
@@ -19,6 +24,9 @@ const MSAT_PER_SAT = 1000
 
 type LNURLoptions struct {
 	Address string
+	// Logger receives initialization and backend errors, nothing is logged
+	// if nil.
+	Logger *slog.Logger
 }
 
 type LnAddressUrlResJson struct {
@@ -28,12 +36,36 @@ type LnAddressUrlResJson struct {
 	Metadata       string `json:"metadata"`
 	CommentAllowed uint   `json:"commentAllowed"`
 	Tag            string `json:"tag"`
+
+	// LUD-21 verify URLs of the invoices created by AddInvoice
+	verifyUrls   map[lntypes.Hash]verifyUrl
+	verifyUrlsMu sync.Mutex
+
+	logger *slog.Logger
 }
 
 type CallbackUrlResJson struct {
-	PR string `json:"pr"`
+	PR     string `json:"pr"`
+	Verify string `json:"verify"`
+}
+
+type VerifyUrlResJson struct {
+	Status   string `json:"status"`
+	Reason   string `json:"reason"`
+	Settled  bool   `json:"settled"`
+	Preimage string `json:"preimage"`
+	PR       string `json:"pr"`
+}
+
+type verifyUrl struct {
+	url       string
+	memo      string
+	expiresAt time.Time
 }
 
+// How long verify URLs are kept after their invoice expired
+const VERIFY_URL_RETENTION = time.Hour
+
 type DecodedPR struct {
 	Currency           string `json:"currency"`
 	CreatedAt          int    `json:"created_at"`
@@ -47,6 +79,20 @@ type DecodedPR struct {
 }
 
 func NewLNURLClient(lnurlOptions LNURLoptions) (*LnAddressUrlResJson, error) {
+	logger := logging.Logger(lnurlOptions.Logger).With(slog.String("backend", LNURL_CLIENT_TYPE))
+	lnAddressUrlRes, err := newLNURLClient(lnurlOptions)
+	if err != nil {
+		logger.Error("Failed to initialize LN client",
+			slog.String("address", lnurlOptions.Address),
+			slog.Any("error", err))
+		return nil, err
+	}
+	lnAddressUrlRes.logger = logger
+	logger.Info("LN client initialized", slog.String("address", lnurlOptions.Address))
+	return lnAddressUrlRes, nil
+}
+
+func newLNURLClient(lnurlOptions LNURLoptions) (*LnAddressUrlResJson, error) {
 	username, domain, err := utils.ParseLnAddress(lnurlOptions.Address)
 	if err != nil {
 		return nil, err
@@ -64,8 +110,22 @@ func NewLNURLClient(lnurlOptions LNURLoptions) (*LnAddressUrlResJson, error) {
 }
 
 func (lnAddressUrlResJson *LnAddressUrlResJson) AddInvoice(ctx context.Context, lnInvoice *lnrpc.Invoice, httpReq *http.Request, options ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error) {
-	callbackUrl := fmt.Sprintf("%s?amount=%d", lnAddressUrlResJson.Callback, MSAT_PER_SAT*lnInvoice.Value)
-	callbackUrlResBody, err := DoGetRequest(callbackUrl)
+	ctx, span := startAddInvoiceSpan(ctx, LNURL_CLIENT_TYPE, lnInvoice)
+	defer span.End()
+	res, err := lnAddressUrlResJson.addInvoice(ctx, lnInvoice)
+	if err != nil {
+		lnAddressUrlResJson.log().ErrorContext(ctx, "AddInvoice failed",
+			slog.String("callback", lnAddressUrlResJson.Callback),
+			slog.Int64("amount_msat", int64(InvoiceAmountMsat(lnInvoice))),
+			slog.Any("error", err))
+	}
+	tracing.RecordError(span, err)
+	return res, err
+}
+
+func (lnAddressUrlResJson *LnAddressUrlResJson) addInvoice(ctx context.Context, lnInvoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error) {
+	callbackUrl := fmt.Sprintf("%s?amount=%d", lnAddressUrlResJson.Callback, uint64(InvoiceAmountMsat(lnInvoice)))
+	callbackUrlResBody, err := DoGetRequestContext(ctx, callbackUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -83,14 +143,92 @@ func (lnAddressUrlResJson *LnAddressUrlResJson) AddInvoice(ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
+	if callbackUrlResJson.Verify != "" {
+		lnAddressUrlResJson.storeVerifyUrl(paymentHash, callbackUrlResJson.Verify, lnInvoice.Memo, time.Unix(int64(decoded.CreatedAt+decoded.Expiry), 0))
+	}
 	return &lnrpc.AddInvoiceResponse{
 		RHash:          paymentHash[:],
 		PaymentRequest: invoice,
 	}, nil
 }
 
+// LookupInvoice asks the LUD-21 verify URL returned along with the invoice
+// whether it has been paid. Invoices from LNURL servers without LUD-21
+// support, or not created by this client, fail with ErrInvoiceNotFound.
+func (lnAddressUrlResJson *LnAddressUrlResJson) LookupInvoice(ctx context.Context, paymentHash lntypes.Hash, options ...grpc.CallOption) (*lnrpc.Invoice, error) {
+	lnAddressUrlResJson.verifyUrlsMu.Lock()
+	verify, ok := lnAddressUrlResJson.verifyUrls[paymentHash]
+	lnAddressUrlResJson.verifyUrlsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: no verify URL known for payment hash %s", ErrInvoiceNotFound, paymentHash)
+	}
+	verifyUrlResBody, err := DoGetRequestContext(ctx, verify.url)
+	if err != nil {
+		return nil, err
+	}
+	verifyUrlResJson := &VerifyUrlResJson{}
+	if err := json.Unmarshal(verifyUrlResBody, verifyUrlResJson); err != nil {
+		return nil, err
+	}
+	if verifyUrlResJson.Status != "OK" {
+		return nil, fmt.Errorf("LNURL verify failed: %s", verifyUrlResJson.Reason)
+	}
+	decoded, err := decodepay.Decodepay(verifyUrlResJson.PR)
+	if err != nil {
+		return nil, err
+	}
+	invoice := &lnrpc.Invoice{
+		RHash:          paymentHash[:],
+		Memo:           verify.memo,
+		PaymentRequest: verifyUrlResJson.PR,
+		ValueMsat:      decoded.MSatoshi,
+		Value:          decoded.MSatoshi / MSAT_PER_SAT,
+		CreationDate:   int64(decoded.CreatedAt),
+		Expiry:         int64(decoded.Expiry),
+		State:          lnrpc.Invoice_OPEN,
+	}
+	if verifyUrlResJson.Settled {
+		preimage, err := lntypes.MakePreimageFromStr(verifyUrlResJson.Preimage)
+		if err != nil {
+			return nil, err
+		}
+		invoice.State = lnrpc.Invoice_SETTLED
+		invoice.RPreimage = preimage[:]
+	}
+	return invoice, nil
+}
+
+// log falls back to discarding for clients not built by NewLNURLClient
+func (lnAddressUrlResJson *LnAddressUrlResJson) log() *slog.Logger {
+	return logging.Logger(lnAddressUrlResJson.logger)
+}
+
+func (lnAddressUrlResJson *LnAddressUrlResJson) storeVerifyUrl(paymentHash lntypes.Hash, url string, memo string, expiresAt time.Time) {
+	lnAddressUrlResJson.verifyUrlsMu.Lock()
+	defer lnAddressUrlResJson.verifyUrlsMu.Unlock()
+	if lnAddressUrlResJson.verifyUrls == nil {
+		lnAddressUrlResJson.verifyUrls = make(map[lntypes.Hash]verifyUrl)
+	}
+	// Forget invoices that can no longer be paid
+	now := time.Now()
+	for hash, verify := range lnAddressUrlResJson.verifyUrls {
+		if now.After(verify.expiresAt.Add(VERIFY_URL_RETENTION)) {
+			delete(lnAddressUrlResJson.verifyUrls, hash)
+		}
+	}
+	lnAddressUrlResJson.verifyUrls[paymentHash] = verifyUrl{url: url, memo: memo, expiresAt: expiresAt}
+}
+
 func DoGetRequest(Url string) ([]byte, error) {
-	res, err := http.Get(Url)
+	return DoGetRequestContext(context.Background(), Url)
+}
+
+func DoGetRequestContext(ctx context.Context, Url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, Url, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return []byte{}, err
 	}
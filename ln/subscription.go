@@ -0,0 +1,151 @@
+package ln
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+)
+
+const (
+	DEFAULT_MIN_BACKOFF = time.Second
+	DEFAULT_MAX_BACKOFF = time.Minute
+)
+
+// InvoiceSubscriptionClient is implemented by LN clients that stream
+// invoice updates, like LNDWrapper.
+type InvoiceSubscriptionClient interface {
+	SubscribeInvoices(ctx context.Context, in *lnrpc.InvoiceSubscription, options ...grpc.CallOption) (lnrpc.Lightning_SubscribeInvoicesClient, error)
+}
+
+// InvoiceSubscriber records the invoice updates streamed by the node into
+// Store. When the stream breaks it reconnects with exponential backoff and
+// resumes from the last add and settle index, so no settlement is missed.
+type InvoiceSubscriber struct {
+	Store InvoiceStore
+	// Filter, if set, skips the invoices it returns false for
+	Filter func(*lnrpc.Invoice) bool
+	// OnUpdate is called after an invoice update has been stored
+	OnUpdate func(*InvoiceState)
+	// OnError is called when the stream breaks, before backing off
+	OnError    func(error)
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	addIndex    uint64
+	settleIndex uint64
+}
+
+// Run subscribes until ctx is done, and only returns ctx.Err() or an error
+// of Store.
+func (subscriber *InvoiceSubscriber) Run(ctx context.Context, client InvoiceSubscriptionClient) error {
+	addIndex, settleIndex, err := subscriber.Store.LastIndexes(ctx)
+	if err != nil {
+		return err
+	}
+	subscriber.addIndex = addIndex
+	subscriber.settleIndex = settleIndex
+
+	backoff := subscriber.minBackoff()
+	for {
+		received, err := subscriber.subscribe(ctx, client)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var storeErr *storeError
+		if errors.As(err, &storeErr) {
+			return err
+		}
+		if subscriber.OnError != nil {
+			subscriber.OnError(err)
+		}
+		if received {
+			backoff = subscriber.minBackoff()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > subscriber.maxBackoff() {
+			backoff = subscriber.maxBackoff()
+		}
+	}
+}
+
+// subscribe consumes one stream until it fails, reporting whether any
+// update was received so the backoff can be reset.
+func (subscriber *InvoiceSubscriber) subscribe(ctx context.Context, client InvoiceSubscriptionClient) (bool, error) {
+	stream, err := client.SubscribeInvoices(ctx, &lnrpc.InvoiceSubscription{
+		AddIndex:    subscriber.addIndex,
+		SettleIndex: subscriber.settleIndex,
+	})
+	if err != nil {
+		return false, err
+	}
+	received := false
+	for {
+		invoice, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+		received = true
+		if err := subscriber.handleInvoice(ctx, invoice); err != nil {
+			return received, err
+		}
+	}
+}
+
+func (subscriber *InvoiceSubscriber) handleInvoice(ctx context.Context, invoice *lnrpc.Invoice) error {
+	// Track the indexes of skipped invoices too, to not replay them on reconnect
+	if invoice.AddIndex > subscriber.addIndex {
+		subscriber.addIndex = invoice.AddIndex
+	}
+	if invoice.SettleIndex > subscriber.settleIndex {
+		subscriber.settleIndex = invoice.SettleIndex
+	}
+	if subscriber.Filter != nil && !subscriber.Filter(invoice) {
+		return nil
+	}
+	invoiceState, err := NewInvoiceState(invoice)
+	if err != nil {
+		// A malformed update shouldn't stop the subscription
+		return nil
+	}
+	if err := subscriber.Store.PutInvoice(ctx, invoiceState); err != nil {
+		return &storeError{err: err}
+	}
+	if subscriber.OnUpdate != nil {
+		subscriber.OnUpdate(invoiceState)
+	}
+	return nil
+}
+
+func (subscriber *InvoiceSubscriber) minBackoff() time.Duration {
+	if subscriber.MinBackoff == 0 {
+		return DEFAULT_MIN_BACKOFF
+	}
+	return subscriber.MinBackoff
+}
+
+func (subscriber *InvoiceSubscriber) maxBackoff() time.Duration {
+	if subscriber.MaxBackoff == 0 {
+		return DEFAULT_MAX_BACKOFF
+	}
+	return subscriber.MaxBackoff
+}
+
+type storeError struct {
+	err error
+}
+
+func (e *storeError) Error() string {
+	return "Failed to store invoice: " + e.err.Error()
+}
+
+func (e *storeError) Unwrap() error {
+	return e.err
+}
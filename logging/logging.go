@@ -0,0 +1,94 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+const REDACTED = "[REDACTED]"
+
+// REDACTED_KEYS are attribute keys, compared case-insensitively, whose
+// values never reach the wrapped handler.
+var REDACTED_KEYS = map[string]bool{
+	"preimage":      true,
+	"macaroon":      true,
+	"macaroon_hex":  true,
+	"cert_hex":      true,
+	"authorization": true,
+	"cookie":        true,
+	"root_key":      true,
+}
+
+var discardLogger = slog.New(discardHandler{})
+
+// Logger wraps logger with a redacting handler. A nil logger discards
+// everything.
+func Logger(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return discardLogger
+	}
+	if _, ok := logger.Handler().(*redactingHandler); ok {
+		return logger
+	}
+	return slog.New(NewRedactingHandler(logger.Handler()))
+}
+
+// NewRedactingHandler returns a handler that replaces the values of
+// REDACTED_KEYS attributes, also inside groups, before passing records on
+// to handler.
+func NewRedactingHandler(handler slog.Handler) slog.Handler {
+	return &redactingHandler{handler: handler}
+}
+
+type redactingHandler struct {
+	handler slog.Handler
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(redact(attr))
+		return true
+	})
+	return h.handler.Handle(ctx, redacted)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		redacted = append(redacted, redact(attr))
+	}
+	return &redactingHandler{handler: h.handler.WithAttrs(redacted)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{handler: h.handler.WithGroup(name)}
+}
+
+func redact(attr slog.Attr) slog.Attr {
+	if REDACTED_KEYS[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, REDACTED)
+	}
+	attr.Value = attr.Value.Resolve()
+	if attr.Value.Kind() == slog.KindGroup {
+		group := attr.Value.Group()
+		redacted := make([]any, 0, len(group))
+		for _, groupAttr := range group {
+			redacted = append(redacted, redact(groupAttr))
+		}
+		return slog.Group(attr.Key, redacted...)
+	}
+	return attr
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
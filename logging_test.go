@@ -0,0 +1,65 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/logging"
+	"github.com/getAlby/lsat-middleware/lsat"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogging(t *testing.T) {
+	buf := &bytes.Buffer{}
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{})
+	lsatmiddleware.Logger = slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	gofight.New().GET("/protected").
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPaymentRequired, res.Code)
+		})
+	for _, preimage := range []string{TEST_PREIMAGE_VALID, TEST_PREIMAGE_INVALID} {
+		gofight.New().GET("/protected").
+			SetHeader(gofight.H{
+				"Authorization": fmt.Sprintf("LSAT %s:%s", TEST_MACAROON_VALID, preimage),
+			}).
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {})
+	}
+	gofight.New().GET("/protected").
+		SetHeader(gofight.H{
+			"Authorization": fmt.Sprintf("LSAT %s", TEST_MACAROON_VALID),
+		}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, res.Code)
+		})
+
+	logs := buf.String()
+	assert.Contains(t, logs, `"msg":"Challenge created"`)
+	assert.Contains(t, logs, `"msg":"LSAT verified"`)
+	assert.Contains(t, logs, fmt.Sprintf(`"reason":"%s"`, lsat.REASON_INVALID_PREIMAGE))
+	assert.Contains(t, logs, fmt.Sprintf(`"reason":"%s"`, lsat.REASON_MALFORMED))
+	assert.NotContains(t, logs, TEST_PREIMAGE_VALID)
+	assert.NotContains(t, logs, TEST_PREIMAGE_INVALID)
+	assert.NotContains(t, logs, TEST_MACAROON_VALID)
+}
+
+func TestLoggingRedaction(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := logging.Logger(slog.New(slog.NewTextHandler(buf, nil)))
+
+	logger.With(slog.String("Macaroon", "secret-macaroon")).Info("test",
+		slog.String("preimage", "secret-preimage"),
+		slog.Group("lnd", slog.String("macaroon_hex", "secret-hex"), slog.String("address", "localhost:10009")))
+
+	logs := buf.String()
+	assert.NotContains(t, logs, "secret")
+	assert.Contains(t, logs, "preimage="+logging.REDACTED)
+	assert.Contains(t, logs, "lnd.address=localhost:10009")
+}
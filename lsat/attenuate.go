@@ -0,0 +1,103 @@
+package lsat
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/utils"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+// Attenuate adds caveats to the LSAT in authField, given as an
+// Authorization header value, and returns the header value of the
+// restricted LSAT. The restricted LSAT can be handed to someone else without
+// the root key: caveats can only be added, and every caveat has to hold, so
+// it never grants more than the original. Attenuate before adding
+// discharges, which are bound to the signature of the macaroon.
+func Attenuate(authField string, caveats []caveat.Caveat) (string, error) {
+	mac, discharges, preimage, err := utils.ParseLsatHeaderWithDischarges(authField)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrMalformedToken, err.Error())
+	}
+	if len(discharges) > 0 {
+		return "", fmt.Errorf("Can't attenuate an LSAT with discharges")
+	}
+	for _, c := range caveats {
+		if err := validateAttenuation(c); err != nil {
+			return "", err
+		}
+	}
+	attenuated := mac.Clone()
+	if err := caveat.AddFirstPartyCaveats(attenuated, caveats); err != nil {
+		return "", err
+	}
+	return formatAuthField(macaroon.Slice{attenuated}, preimage)
+}
+
+func formatAuthField(macs macaroon.Slice, preimage lntypes.Preimage) (string, error) {
+	macBytes, err := macs.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s:%s", LSAT_HEADER, base64.StdEncoding.EncodeToString(macBytes), preimage.String()), nil
+}
+
+func validateAttenuation(c caveat.Caveat) error {
+	if c.Condition == "" || strings.Contains(c.Condition, "=") {
+		return fmt.Errorf("Invalid caveat condition: %q", c.Condition)
+	}
+	switch c.Condition {
+	case caveat.VALID_UNTIL:
+		if _, err := strconv.ParseInt(c.Value, 10, 64); err != nil {
+			return fmt.Errorf("Invalid %s caveat: %s", c.Condition, c.Value)
+		}
+	case caveat.MAX_USES:
+		if uses, err := strconv.ParseInt(c.Value, 10, 64); err != nil || uses < 1 {
+			return fmt.Errorf("Invalid %s caveat: %s", c.Condition, c.Value)
+		}
+	}
+	return nil
+}
+
+// UseLimit is a max_uses caveat of a macaroon. Key identifies the macaroon
+// up to and including the caveat, so LSATs derived from it by adding
+// further caveats share its count.
+type UseLimit struct {
+	Key     string
+	MaxUses int64
+}
+
+// UseLimits returns the max_uses caveats of mac.
+func UseLimits(mac *macaroon.Macaroon) ([]UseLimit, error) {
+	useLimits := []UseLimit{}
+	hash := sha256.New()
+	hash.Write(mac.Id())
+	for _, rawCaveat := range mac.Caveats() {
+		// Length prefixes keep the encoding of the caveat chain unambiguous
+		fmt.Fprintf(hash, "%d:", len(rawCaveat.Id))
+		hash.Write(rawCaveat.Id)
+		if rawCaveat.VerificationId != nil {
+			continue
+		}
+		c, err := caveat.DecodeCaveat(string(rawCaveat.Id))
+		if err != nil || c.Condition != caveat.MAX_USES {
+			continue
+		}
+		maxUses, err := strconv.ParseInt(c.Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrCaveatMismatch, err.Error())
+		}
+		useLimits = append(useLimits, UseLimit{
+			Key:     hex.EncodeToString(hash.Sum(nil)),
+			MaxUses: maxUses,
+		})
+	}
+	return useLimits, nil
+}
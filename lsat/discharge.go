@@ -0,0 +1,37 @@
+package lsat
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/utils"
+
+	"gopkg.in/macaroon.v2"
+)
+
+// Discharge asks service to discharge the third-party caveats of the LSAT
+// in authField and returns the header value carrying the LSAT followed by
+// the discharges, bound to it.
+func Discharge(ctx context.Context, authField string, service caveat.DischargeService) (string, error) {
+	mac, discharges, preimage, err := utils.ParseLsatHeaderWithDischarges(authField)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrMalformedToken, err.Error())
+	}
+	if len(discharges) > 0 {
+		return "", fmt.Errorf("LSAT already has discharges")
+	}
+	macs := macaroon.Slice{mac}
+	for _, c := range mac.Caveats() {
+		if c.VerificationId == nil {
+			continue
+		}
+		discharge, err := service.Discharge(ctx, c.Location, c.Id)
+		if err != nil {
+			return "", err
+		}
+		discharge.Bind(mac.Signature())
+		macs = append(macs, discharge)
+	}
+	return formatAuthField(macs, preimage)
+}
@@ -0,0 +1,77 @@
+package lsat
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+var (
+	ErrInvalidSignature    = errors.New("Invalid LSAT signature")
+	ErrCaveatMismatch      = errors.New("Caveats don't match")
+	ErrInvalidPreimage     = errors.New("Invalid Preimage")
+	ErrExpired             = errors.New("LSAT has expired")
+	ErrRevoked             = errors.New("LSAT has been revoked")
+	ErrInvoiceCreation     = errors.New("Failed to create invoice")
+	ErrMalformedToken      = errors.New("Malformed LSAT")
+	ErrPricing             = errors.New("Failed to price request")
+	ErrCaveats             = errors.New("Failed to compute caveats")
+	ErrInsufficientTier    = errors.New("LSAT tier does not cover route")
+	ErrInsufficientBalance = errors.New("LSAT balance is too low")
+	ErrRateLimited         = errors.New("Too many challenges requested")
+	ErrInvoiceCapacity     = errors.New("Too many invoices being created")
+)
+
+// InvalidPreimageError is returned when the preimage presented with a
+// macaroon does not hash to the payment hash the macaroon was minted for.
+// It matches ErrInvalidPreimage with errors.Is.
+type InvalidPreimageError struct {
+	Preimage    lntypes.Preimage
+	PaymentHash lntypes.Hash
+}
+
+func (e *InvalidPreimageError) Error() string {
+	return fmt.Sprintf("Invalid Preimage %s for PaymentHash %s", e.Preimage, e.PaymentHash)
+}
+
+func (e *InvalidPreimageError) Is(target error) bool {
+	return target == ErrInvalidPreimage
+}
+
+// Reasons name the kind of a verification error in logs and metrics
+// without exposing the token.
+const (
+	REASON_MALFORMED            = "malformed"
+	REASON_INVALID_SIGNATURE    = "invalid_signature"
+	REASON_CAVEAT_MISMATCH      = "caveat_mismatch"
+	REASON_INVALID_PREIMAGE     = "invalid_preimage"
+	REASON_EXPIRED              = "expired"
+	REASON_REVOKED              = "revoked"
+	REASON_INSUFFICIENT_TIER    = "insufficient_tier"
+	REASON_INSUFFICIENT_BALANCE = "insufficient_balance"
+	REASON_OTHER                = "other"
+)
+
+func ErrorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrMalformedToken):
+		return REASON_MALFORMED
+	case errors.Is(err, ErrInvalidSignature):
+		return REASON_INVALID_SIGNATURE
+	case errors.Is(err, ErrCaveatMismatch):
+		return REASON_CAVEAT_MISMATCH
+	case errors.Is(err, ErrInvalidPreimage):
+		return REASON_INVALID_PREIMAGE
+	case errors.Is(err, ErrExpired):
+		return REASON_EXPIRED
+	case errors.Is(err, ErrRevoked):
+		return REASON_REVOKED
+	case errors.Is(err, ErrInsufficientTier):
+		return REASON_INSUFFICIENT_TIER
+	case errors.Is(err, ErrInsufficientBalance):
+		return REASON_INSUFFICIENT_BALANCE
+	default:
+		return REASON_OTHER
+	}
+}
@@ -1,12 +1,17 @@
 package lsat
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/getAlby/lsat-middleware/caveat"
 	macaroonutils "github.com/getAlby/lsat-middleware/macaroon"
+	"github.com/getAlby/lsat-middleware/tracing"
 
 	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
 	"gopkg.in/macaroon.v2"
 )
 
@@ -28,16 +33,35 @@ type LsatInfo struct {
 	Type        string
 	Preimage    lntypes.Preimage
 	PaymentHash lntypes.Hash
+	TokenId     [32]byte
+	Caveats     []caveat.Caveat
 	Amount      int64
+	AmountMsat  lnwire.MilliSatoshi
+	IssuedAt    time.Time
+	// BalanceMsat is the prepaid balance left, if the middleware has a Ledger
+	BalanceMsat lnwire.MilliSatoshi
 	Error       error
 }
 
 func VerifyLSAT(mac *macaroon.Macaroon, conditions []caveat.Caveat, rootKey []byte, preimage lntypes.Preimage) error {
-	rawCaveats, err := mac.VerifySignature(rootKey, nil)
+	return VerifyLSATContext(context.Background(), mac, conditions, rootKey, preimage)
+}
+
+// VerifyLSATContext is VerifyLSAT recording the signature and caveat checks
+// as spans of the trace in ctx.
+func VerifyLSATContext(ctx context.Context, mac *macaroon.Macaroon, conditions []caveat.Caveat, rootKey []byte, preimage lntypes.Preimage) error {
+	return VerifyLSATWithDischarges(ctx, mac, nil, conditions, rootKey, preimage)
+}
+
+// VerifyLSATWithDischarges is VerifyLSATContext for macaroons with
+// third-party caveats. discharges have to be bound to mac and their
+// first-party caveats have to hold as well.
+func VerifyLSATWithDischarges(ctx context.Context, mac *macaroon.Macaroon, discharges []*macaroon.Macaroon, conditions []caveat.Caveat, rootKey []byte, preimage lntypes.Preimage) error {
+	rawCaveats, err := verifySignature(ctx, mac, discharges, rootKey)
 	if err != nil {
 		return err
 	}
-	if err := caveat.VerifyCaveats(rawCaveats, conditions); err != nil {
+	if err := verifyCaveats(ctx, rawCaveats, conditions); err != nil {
 		return err
 	}
 	macaroonId, err := macaroonutils.GetMacIdFromMacaroon(mac)
@@ -45,7 +69,81 @@ func VerifyLSAT(mac *macaroon.Macaroon, conditions []caveat.Caveat, rootKey []by
 		return err
 	}
 	if macaroonId.PaymentHash != preimage.Hash() {
-		return fmt.Errorf("Invalid Preimage %s for PaymentHash %s", preimage, macaroonId.PaymentHash)
+		return &InvalidPreimageError{Preimage: preimage, PaymentHash: macaroonId.PaymentHash}
+	}
+	return nil
+}
+
+// GetPaidLsatInfo describes a macaroon that has already passed VerifyLSAT.
+func GetPaidLsatInfo(mac *macaroon.Macaroon, preimage lntypes.Preimage) (*LsatInfo, error) {
+	macaroonId, err := macaroonutils.GetMacIdFromMacaroon(mac)
+	if err != nil {
+		return nil, err
+	}
+	rawCaveats := make([]string, 0, len(mac.Caveats()))
+	for _, c := range mac.Caveats() {
+		// Third-party caveat IDs are opaque
+		if c.VerificationId != nil {
+			continue
+		}
+		rawCaveats = append(rawCaveats, string(c.Id))
+	}
+	lsatInfo := &LsatInfo{
+		Type:        LSAT_TYPE_PAID,
+		Preimage:    preimage,
+		PaymentHash: macaroonId.PaymentHash,
+		TokenId:     macaroonId.TokenId,
+		Caveats:     caveat.DecodeCaveats(rawCaveats),
+		Amount:      macaroonId.Amount,
+		AmountMsat:  lnwire.MilliSatoshi(macaroonId.AmountMsat),
+	}
+	if lsatInfo.AmountMsat == 0 {
+		lsatInfo.AmountMsat = lnwire.MilliSatoshi(macaroonId.Amount * 1000)
+	}
+	// Macaroons minted before the issue time was recorded leave it zero
+	if macaroonId.IssuedAt != 0 {
+		lsatInfo.IssuedAt = time.Unix(macaroonId.IssuedAt, 0)
+	}
+	return lsatInfo, nil
+}
+
+func verifySignature(ctx context.Context, mac *macaroon.Macaroon, discharges []*macaroon.Macaroon, rootKey []byte) ([]string, error) {
+	_, span := tracing.Tracer().Start(ctx, "lsat.VerifySignature")
+	defer span.End()
+	rawCaveats, err := mac.VerifySignature(rootKey, discharges)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrInvalidSignature, err.Error())
+		tracing.RecordReason(span, REASON_INVALID_SIGNATURE, err)
+		return nil, err
+	}
+	return rawCaveats, nil
+}
+
+func verifyCaveats(ctx context.Context, rawCaveats []string, conditions []caveat.Caveat) (err error) {
+	_, span := tracing.Tracer().Start(ctx, "lsat.VerifyCaveats")
+	defer func() {
+		tracing.RecordReason(span, ErrorReason(err), err)
+		span.End()
+	}()
+	if err := caveat.VerifyCaveats(rawCaveats, conditions); err != nil {
+		return ErrCaveatMismatch
+	}
+	return verifyExpiry(caveat.DecodeCaveats(rawCaveats), time.Now())
+}
+
+func verifyExpiry(caveats []caveat.Caveat, now time.Time) error {
+	// Every valid_until caveat has to hold, so adding one can only shorten the lifetime
+	for _, c := range caveats {
+		if c.Condition != caveat.VALID_UNTIL {
+			continue
+		}
+		validUntil, err := strconv.ParseInt(c.Value, 10, 64)
+		if err != nil {
+			return ErrCaveatMismatch
+		}
+		if now.Unix() > validUntil {
+			return ErrExpired
+		}
 	}
 	return nil
 }
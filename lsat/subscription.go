@@ -0,0 +1,92 @@
+package lsat
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	macaroonutils "github.com/getAlby/lsat-middleware/macaroon"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+// SubscriptionExpiry returns the index and expiry of the valid_until caveat
+// of a subscription LSAT: the one right before its first plan caveat. The
+// holder can only add caveats after those minted with the LSAT, so it is
+// the one the middleware minted.
+func SubscriptionExpiry(mac *macaroon.Macaroon) (int, time.Time, bool) {
+	caveats := mac.Caveats()
+	for i, c := range caveats {
+		if c.VerificationId != nil {
+			continue
+		}
+		decoded, err := caveat.DecodeCaveat(string(c.Id))
+		if err != nil || decoded.Condition != caveat.PLAN {
+			continue
+		}
+		if i == 0 || caveats[i-1].VerificationId != nil {
+			return 0, time.Time{}, false
+		}
+		previous, err := caveat.DecodeCaveat(string(caveats[i-1].Id))
+		if err != nil || previous.Condition != caveat.VALID_UNTIL {
+			return 0, time.Time{}, false
+		}
+		validUntil, err := strconv.ParseInt(previous.Value, 10, 64)
+		if err != nil {
+			return 0, time.Time{}, false
+		}
+		return i - 1, time.Unix(validUntil, 0), true
+	}
+	return 0, time.Time{}, false
+}
+
+// VerifySubscription is VerifyLSATWithDischarges for subscription LSATs
+// whose access was renewed until paidUntil: their subscription expiry is
+// checked against the later of itself and paidUntil. Every other
+// valid_until caveat still has to hold.
+func VerifySubscription(ctx context.Context, mac *macaroon.Macaroon, discharges []*macaroon.Macaroon, conditions []caveat.Caveat, rootKey []byte, preimage lntypes.Preimage, paidUntil time.Time) error {
+	rawCaveats, err := verifySignature(ctx, mac, discharges, rootKey)
+	if err != nil {
+		return err
+	}
+	if err := caveat.VerifyCaveats(rawCaveats, conditions); err != nil {
+		return ErrCaveatMismatch
+	}
+	index, expiry, ok := SubscriptionExpiry(mac)
+	if !ok {
+		return ErrExpired
+	}
+	now := time.Now()
+	if paidUntil.After(expiry) {
+		expiry = paidUntil
+	}
+	if now.Unix() > expiry.Unix() {
+		return ErrExpired
+	}
+	others := []string{}
+	for i, c := range mac.Caveats() {
+		if i != index && c.VerificationId == nil {
+			others = append(others, string(c.Id))
+		}
+	}
+	for _, discharge := range discharges {
+		for _, c := range discharge.Caveats() {
+			if c.VerificationId == nil {
+				others = append(others, string(c.Id))
+			}
+		}
+	}
+	if err := verifyExpiry(caveat.DecodeCaveats(others), now); err != nil {
+		return err
+	}
+	macaroonId, err := macaroonutils.GetMacIdFromMacaroon(mac)
+	if err != nil {
+		return err
+	}
+	if macaroonId.PaymentHash != preimage.Hash() {
+		return &InvalidPreimageError{Preimage: preimage, PaymentHash: macaroonId.PaymentHash}
+	}
+	return nil
+}
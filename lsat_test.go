@@ -0,0 +1,80 @@
+package test
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/lsat"
+	macaroonutils "github.com/getAlby/lsat-middleware/macaroon"
+	"github.com/getAlby/lsat-middleware/utils"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/stretchr/testify/assert"
+)
+
+var testConditions = []caveat.Caveat{
+	caveat.NewCaveat("RequestPath", "/protected"),
+}
+
+func TestVerifyLSATErrors(t *testing.T) {
+	mac, err := utils.GetMacaroonFromString(TEST_MACAROON_VALID)
+	assert.NoError(t, err)
+	preimage, err := utils.GetPreimageFromString(TEST_PREIMAGE_VALID)
+	assert.NoError(t, err)
+	invalidPreimage, err := utils.GetPreimageFromString(TEST_PREIMAGE_INVALID)
+	assert.NoError(t, err)
+
+	err = lsat.VerifyLSAT(mac, testConditions, []byte(ROOT_KEY), preimage)
+	assert.NoError(t, err)
+
+	err = lsat.VerifyLSAT(mac, testConditions, []byte("wrong root key"), preimage)
+	assert.True(t, errors.Is(err, lsat.ErrInvalidSignature))
+
+	err = lsat.VerifyLSAT(mac, []caveat.Caveat{caveat.NewCaveat("RequestPath", "/other")}, []byte(ROOT_KEY), preimage)
+	assert.True(t, errors.Is(err, lsat.ErrCaveatMismatch))
+
+	err = lsat.VerifyLSAT(mac, testConditions, []byte(ROOT_KEY), invalidPreimage)
+	assert.True(t, errors.Is(err, lsat.ErrInvalidPreimage))
+	var preimageErr *lsat.InvalidPreimageError
+	assert.True(t, errors.As(err, &preimageErr))
+	assert.Equal(t, invalidPreimage, preimageErr.Preimage)
+}
+
+func TestVerifyLSATExpired(t *testing.T) {
+	preimage, err := utils.GetPreimageFromString(TEST_PREIMAGE_VALID)
+	assert.NoError(t, err)
+	validUntil := caveat.NewCaveat(caveat.VALID_UNTIL, strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+
+	macaroonString, err := macaroonutils.GetMacaroonAsString(preimage.Hash(), 10000, append(testConditions, validUntil), []byte(ROOT_KEY))
+	assert.NoError(t, err)
+	mac, err := utils.GetMacaroonFromString(macaroonString)
+	assert.NoError(t, err)
+
+	err = lsat.VerifyLSAT(mac, testConditions, []byte(ROOT_KEY), preimage)
+	assert.True(t, errors.Is(err, lsat.ErrExpired))
+}
+
+func TestGetPaidLsatInfo(t *testing.T) {
+	preimage, err := utils.GetPreimageFromString(TEST_PREIMAGE_VALID)
+	assert.NoError(t, err)
+
+	macaroonString, err := macaroonutils.GetMacaroonAsString(preimage.Hash(), 21000, testConditions, []byte(ROOT_KEY))
+	assert.NoError(t, err)
+	mac, err := utils.GetMacaroonFromString(macaroonString)
+	assert.NoError(t, err)
+	macaroonId, err := macaroonutils.GetMacIdFromMacaroon(mac)
+	assert.NoError(t, err)
+
+	lsatInfo, err := lsat.GetPaidLsatInfo(mac, preimage)
+	assert.NoError(t, err)
+	assert.Equal(t, lsat.LSAT_TYPE_PAID, lsatInfo.Type)
+	assert.Equal(t, preimage.Hash(), lsatInfo.PaymentHash)
+	assert.Equal(t, macaroonId.TokenId, lsatInfo.TokenId)
+	assert.Equal(t, testConditions, lsatInfo.Caveats)
+	assert.Equal(t, int64(21), lsatInfo.Amount)
+	assert.Equal(t, lnwire.MilliSatoshi(21000), lsatInfo.AmountMsat)
+	assert.WithinDuration(t, time.Now(), lsatInfo.IssuedAt, time.Minute)
+}
@@ -5,9 +5,11 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/gob"
+	"time"
 
 	"github.com/getAlby/lsat-middleware/caveat"
 	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
 	"gopkg.in/macaroon.v2"
 )
 
@@ -15,17 +17,40 @@ type MacaroonIdentifier struct {
 	Version     uint16
 	PaymentHash lntypes.Hash
 	TokenId     [32]byte
+	Amount      int64
+	IssuedAt    int64
+	// AmountMsat is zero in macaroons minted before msat amounts
+	AmountMsat int64
 }
 
-func GetMacaroonAsString(paymentHash lntypes.Hash, caveats []caveat.Caveat, rootKey []byte) (string, error) {
+func GetMacaroonAsString(paymentHash lntypes.Hash, amountMsat lnwire.MilliSatoshi, caveats []caveat.Caveat, rootKey []byte) (string, error) {
+	mac, err := NewMacaroon(paymentHash, amountMsat, caveats, nil, rootKey)
+	if err != nil {
+		return "", err
+	}
+	return GetMacaroonString(mac)
+}
+
+// NewMacaroon mints a macaroon with caveats followed by thirdPartyCaveats.
+func NewMacaroon(paymentHash lntypes.Hash, amountMsat lnwire.MilliSatoshi, caveats []caveat.Caveat, thirdPartyCaveats []caveat.ThirdPartyCaveat, rootKey []byte) (*macaroon.Macaroon, error) {
+	tokenId, err := generateTokenId()
+	if err != nil {
+		return nil, err
+	}
+	return NewMacaroonWithTokenId(tokenId, paymentHash, amountMsat, caveats, thirdPartyCaveats, rootKey)
+}
+
+// NewMacaroonWithTokenId is NewMacaroon for a macaroon replacing another
+// one with tokenId, e.g. when upgrading an LSAT.
+func NewMacaroonWithTokenId(tokenId [32]byte, paymentHash lntypes.Hash, amountMsat lnwire.MilliSatoshi, caveats []caveat.Caveat, thirdPartyCaveats []caveat.ThirdPartyCaveat, rootKey []byte) (*macaroon.Macaroon, error) {
 	// rootKey, err := generateRootKey()
 	// if err != nil {
 	// 	return "", err
 	// }
 
-	identifier, err := generateMacaroonIdentifier(paymentHash)
+	identifier, err := generateMacaroonIdentifier(tokenId, paymentHash, amountMsat)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	mac, err := macaroon.New(
@@ -35,13 +60,19 @@ func GetMacaroonAsString(paymentHash lntypes.Hash, caveats []caveat.Caveat, root
 		macaroon.LatestVersion,
 	)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if err := caveat.AddFirstPartyCaveats(mac, caveats); err != nil {
-		return "", err
+		return nil, err
+	}
+	if err := caveat.AddThirdPartyCaveats(mac, thirdPartyCaveats); err != nil {
+		return nil, err
 	}
+	return mac, nil
+}
 
+func GetMacaroonString(mac *macaroon.Macaroon) (string, error) {
 	macBytes, err := mac.MarshalBinary()
 	if err != nil {
 		return "", err
@@ -51,16 +82,14 @@ func GetMacaroonAsString(paymentHash lntypes.Hash, caveats []caveat.Caveat, root
 	return macaroonString, err
 }
 
-func generateMacaroonIdentifier(paymentHash lntypes.Hash) ([]byte, error) {
-	tokenId, err := generateTokenId()
-	if err != nil {
-		return nil, err
-	}
-
+func generateMacaroonIdentifier(tokenId [32]byte, paymentHash lntypes.Hash, amountMsat lnwire.MilliSatoshi) ([]byte, error) {
 	id := &MacaroonIdentifier{
 		Version:     0,
 		PaymentHash: paymentHash,
 		TokenId:     tokenId,
+		Amount:      int64(amountMsat.ToSatoshis()),
+		IssuedAt:    time.Now().Unix(),
+		AmountMsat:  int64(amountMsat),
 	}
 
 	var identifier bytes.Buffer
@@ -68,7 +97,7 @@ func generateMacaroonIdentifier(paymentHash lntypes.Hash) ([]byte, error) {
 	if err := enc.Encode(id); err != nil {
 		return nil, err
 	}
-	return identifier.Bytes(), err
+	return identifier.Bytes(), nil
 }
 
 func GetMacIdFromMacaroon(mac *macaroon.Macaroon) (*MacaroonIdentifier, error) {
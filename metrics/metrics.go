@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/getAlby/lsat-middleware/ln"
+	"github.com/getAlby/lsat-middleware/lsat"
+	"github.com/getAlby/lsat-middleware/middleware"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DEFAULT_NAMESPACE = "lsat"
+
+	OUTCOME_PAID     = "paid"
+	OUTCOME_REJECTED = "rejected"
+
+	REASON_NONE                 = "none"
+	REASON_MALFORMED            = lsat.REASON_MALFORMED
+	REASON_INVALID_SIGNATURE    = lsat.REASON_INVALID_SIGNATURE
+	REASON_CAVEAT_MISMATCH      = lsat.REASON_CAVEAT_MISMATCH
+	REASON_INVALID_PREIMAGE     = lsat.REASON_INVALID_PREIMAGE
+	REASON_EXPIRED              = lsat.REASON_EXPIRED
+	REASON_REVOKED              = lsat.REASON_REVOKED
+	REASON_INSUFFICIENT_TIER    = lsat.REASON_INSUFFICIENT_TIER
+	REASON_INSUFFICIENT_BALANCE = lsat.REASON_INSUFFICIENT_BALANCE
+	REASON_OTHER                = lsat.REASON_OTHER
+)
+
+type Config struct {
+	// Namespace prefixes all metric names, DEFAULT_NAMESPACE if empty
+	Namespace string
+	// RouteFunc labels requests, the URL path by default. Return a route
+	// pattern instead if paths contain IDs, to bound label cardinality.
+	RouteFunc func(req *http.Request) string
+	// Buckets of the AddInvoice latency histogram in seconds,
+	// prometheus.DefBuckets if empty
+	Buckets []float64
+}
+
+// Collector records LSAT metrics through the hooks of an LsatMiddleware. It
+// implements prometheus.Collector, so register it with a registry.
+type Collector struct {
+	routeFunc func(req *http.Request) string
+
+	challenges      *prometheus.CounterVec
+	invoices        *prometheus.CounterVec
+	verifications   *prometheus.CounterVec
+	satsInvoiced    *prometheus.CounterVec
+	satsPaid        prometheus.Counter
+	invoiceDuration *prometheus.HistogramVec
+}
+
+func NewCollector(config Config) *Collector {
+	namespace := config.Namespace
+	if namespace == "" {
+		namespace = DEFAULT_NAMESPACE
+	}
+	routeFunc := config.RouteFunc
+	if routeFunc == nil {
+		routeFunc = func(req *http.Request) string {
+			return req.URL.Path
+		}
+	}
+	buckets := config.Buckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	return &Collector{
+		routeFunc: routeFunc,
+		challenges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "challenges_total",
+			Help:      "402 challenges issued.",
+		}, []string{"route"}),
+		invoices: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "invoices_created_total",
+			Help:      "Invoices created.",
+		}, []string{"backend", "route"}),
+		verifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "verifications_total",
+			Help:      "LSAT verifications by outcome and rejection reason.",
+		}, []string{"outcome", "reason"}),
+		satsInvoiced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sats_invoiced_total",
+			Help:      "Sats requested in created invoices.",
+		}, []string{"backend", "route"}),
+		satsPaid: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sats_paid_total",
+			Help:      "Sats received in settled invoices.",
+		}),
+		invoiceDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "add_invoice_duration_seconds",
+			Help:      "Latency of successful AddInvoice calls.",
+			Buckets:   buckets,
+		}, []string{"backend"}),
+	}
+}
+
+func (collector *Collector) Describe(ch chan<- *prometheus.Desc) {
+	collector.challenges.Describe(ch)
+	collector.invoices.Describe(ch)
+	collector.verifications.Describe(ch)
+	collector.satsInvoiced.Describe(ch)
+	collector.satsPaid.Describe(ch)
+	collector.invoiceDuration.Describe(ch)
+}
+
+func (collector *Collector) Collect(ch chan<- prometheus.Metric) {
+	collector.challenges.Collect(ch)
+	collector.invoices.Collect(ch)
+	collector.verifications.Collect(ch)
+	collector.satsInvoiced.Collect(ch)
+	collector.satsPaid.Collect(ch)
+	collector.invoiceDuration.Collect(ch)
+}
+
+// Instrument sets the hooks of lsatMiddleware to record metrics, calling
+// any hooks that were set before.
+func (collector *Collector) Instrument(lsatMiddleware *middleware.LsatMiddleware) {
+	backend := ln.ClientType(lsatMiddleware.LNClient)
+
+	lsatMiddleware.OnChallenge = chainHook(lsatMiddleware.OnChallenge, func(req *http.Request, lsatInfo *lsat.LsatInfo, metadata *middleware.HookMetadata) {
+		collector.challenges.WithLabelValues(collector.routeFunc(req)).Inc()
+	})
+	lsatMiddleware.OnInvoiceCreated = chainHook(lsatMiddleware.OnInvoiceCreated, func(req *http.Request, lsatInfo *lsat.LsatInfo, metadata *middleware.HookMetadata) {
+		route := collector.routeFunc(req)
+		collector.invoices.WithLabelValues(backend, route).Inc()
+		collector.satsInvoiced.WithLabelValues(backend, route).Add(float64(metadata.Challenge.AmountMsat) / 1000)
+		if !metadata.Pooled {
+			collector.invoiceDuration.WithLabelValues(backend).Observe(metadata.Duration.Seconds())
+		}
+	})
+	lsatMiddleware.OnVerified = chainHook(lsatMiddleware.OnVerified, func(req *http.Request, lsatInfo *lsat.LsatInfo, metadata *middleware.HookMetadata) {
+		collector.verifications.WithLabelValues(OUTCOME_PAID, REASON_NONE).Inc()
+	})
+	lsatMiddleware.OnRejected = chainHook(lsatMiddleware.OnRejected, func(req *http.Request, lsatInfo *lsat.LsatInfo, metadata *middleware.HookMetadata) {
+		collector.verifications.WithLabelValues(OUTCOME_REJECTED, RejectionReason(lsatInfo.Error)).Inc()
+	})
+}
+
+// ObserveInvoice counts the sats of settled invoices. Pass it to
+// LsatMiddleware.SubscribeInvoices.
+func (collector *Collector) ObserveInvoice(invoiceState *ln.InvoiceState) {
+	if invoiceState.IsSettled() {
+		collector.satsPaid.Add(float64(invoiceState.AmountPaidMsat / 1000))
+	}
+}
+
+// RejectionReason maps a verification error to a metric label.
+func RejectionReason(err error) string {
+	return lsat.ErrorReason(err)
+}
+
+func chainHook(previous, hook middleware.Hook) middleware.Hook {
+	if previous == nil {
+		return hook
+	}
+	return func(req *http.Request, lsatInfo *lsat.LsatInfo, metadata *middleware.HookMetadata) {
+		previous(req, lsatInfo, metadata)
+		hook(req, lsatInfo, metadata)
+	}
+}
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/ln"
+	"github.com/getAlby/lsat-middleware/lsat"
+	"github.com/getAlby/lsat-middleware/metrics"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	collector := metrics.NewCollector(metrics.Config{})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{})
+	collector.Instrument(lsatmiddleware)
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	gofight.New().GET("/protected").
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPaymentRequired, res.Code)
+		})
+	gofight.New().GET("/protected").
+		SetHeader(gofight.H{
+			"Authorization": fmt.Sprintf("LSAT %s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_VALID),
+		}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusAccepted, res.Code)
+		})
+	gofight.New().GET("/protected").
+		SetHeader(gofight.H{
+			"Authorization": fmt.Sprintf("LSAT %s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_INVALID),
+		}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPaymentRequired, res.Code)
+		})
+	collector.ObserveInvoice(&ln.InvoiceState{
+		State:          lnrpc.Invoice_SETTLED,
+		AmountPaidMsat: 10000,
+	})
+
+	expected := `
+# HELP lsat_challenges_total 402 challenges issued.
+# TYPE lsat_challenges_total counter
+lsat_challenges_total{route="/protected"} 2
+# HELP lsat_invoices_created_total Invoices created.
+# TYPE lsat_invoices_created_total counter
+lsat_invoices_created_total{backend="*test.MockLNClient",route="/protected"} 2
+# HELP lsat_sats_invoiced_total Sats requested in created invoices.
+# TYPE lsat_sats_invoiced_total counter
+lsat_sats_invoiced_total{backend="*test.MockLNClient",route="/protected"} 20
+# HELP lsat_sats_paid_total Sats received in settled invoices.
+# TYPE lsat_sats_paid_total counter
+lsat_sats_paid_total 10
+# HELP lsat_verifications_total LSAT verifications by outcome and rejection reason.
+# TYPE lsat_verifications_total counter
+lsat_verifications_total{outcome="paid",reason="none"} 1
+lsat_verifications_total{outcome="rejected",reason="invalid_preimage"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"lsat_challenges_total",
+		"lsat_invoices_created_total",
+		"lsat_sats_invoiced_total",
+		"lsat_sats_paid_total",
+		"lsat_verifications_total",
+	))
+	assert.Equal(t, 1, testutil.CollectAndCount(collector, "lsat_add_invoice_duration_seconds"))
+	assert.Equal(t, metrics.REASON_EXPIRED, metrics.RejectionReason(fmt.Errorf("%w: token", lsat.ErrExpired)))
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/lsat"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// Ledger holds the prepaid balances of LSATs by token ID. Implementations
+// must be safe for concurrent use.
+type Ledger interface {
+	// Credit adds amountMsat paid with paymentHash to the balance of
+	// tokenId, once per payment hash, and returns the balance.
+	Credit(ctx context.Context, tokenId [32]byte, paymentHash lntypes.Hash, amountMsat lnwire.MilliSatoshi) (lnwire.MilliSatoshi, error)
+	// Debit takes amountMsat from the balance of tokenId and returns what
+	// is left. It fails with lsat.ErrInsufficientBalance, leaving the
+	// balance unchanged, if the balance is lower than amountMsat.
+	Debit(ctx context.Context, tokenId [32]byte, amountMsat lnwire.MilliSatoshi) (lnwire.MilliSatoshi, error)
+	Balance(ctx context.Context, tokenId [32]byte) (lnwire.MilliSatoshi, error)
+}
+
+// MemoryLedger keeps balances in memory, they are lost on restart.
+type MemoryLedger struct {
+	mu       sync.Mutex
+	balances map[[32]byte]lnwire.MilliSatoshi
+	credited map[lntypes.Hash]bool
+}
+
+func NewMemoryLedger() *MemoryLedger {
+	return &MemoryLedger{
+		balances: make(map[[32]byte]lnwire.MilliSatoshi),
+		credited: make(map[lntypes.Hash]bool),
+	}
+}
+
+func (ledger *MemoryLedger) Credit(ctx context.Context, tokenId [32]byte, paymentHash lntypes.Hash, amountMsat lnwire.MilliSatoshi) (lnwire.MilliSatoshi, error) {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	if !ledger.credited[paymentHash] {
+		ledger.credited[paymentHash] = true
+		ledger.balances[tokenId] += amountMsat
+	}
+	return ledger.balances[tokenId], nil
+}
+
+func (ledger *MemoryLedger) Debit(ctx context.Context, tokenId [32]byte, amountMsat lnwire.MilliSatoshi) (lnwire.MilliSatoshi, error) {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	balance := ledger.balances[tokenId]
+	if balance < amountMsat {
+		return balance, lsat.ErrInsufficientBalance
+	}
+	ledger.balances[tokenId] = balance - amountMsat
+	return ledger.balances[tokenId], nil
+}
+
+func (ledger *MemoryLedger) Balance(ctx context.Context, tokenId [32]byte) (lnwire.MilliSatoshi, error) {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	return ledger.balances[tokenId], nil
+}
+
+// debit credits the payment of the LSAT of lsatInfo to its balance, if not
+// done yet, and debits the price of req.
+func (lsatMiddleware *LsatMiddleware) debit(ctx context.Context, req *http.Request, lsatInfo *lsat.LsatInfo) error {
+	ledger := lsatMiddleware.Ledger
+	if _, err := ledger.Credit(ctx, lsatInfo.TokenId, lsatInfo.PaymentHash, lsatInfo.AmountMsat); err != nil {
+		return err
+	}
+	amountMsat, err := lsatMiddleware.amountMsat(req)
+	if err != nil {
+		return fmt.Errorf("%w: %s", lsat.ErrPricing, err.Error())
+	}
+	balance, err := ledger.Debit(ctx, lsatInfo.TokenId, amountMsat)
+	lsatInfo.BalanceMsat = balance
+	return err
+}
+
+// canTopUp reports whether the LSAT of lsatInfo ran out of balance and can
+// be topped up. LSATs with max_uses caveats aren't, the top-up would
+// restart their count.
+func (lsatMiddleware *LsatMiddleware) canTopUp(lsatInfo *lsat.LsatInfo) bool {
+	if lsatMiddleware.Ledger == nil || lsatInfo == nil || !errors.Is(lsatInfo.Error, lsat.ErrInsufficientBalance) {
+		return false
+	}
+	for _, c := range lsatInfo.Caveats {
+		if c.Condition == caveat.MAX_USES {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/getAlby/lsat-middleware/lsat"
+	"github.com/getAlby/lsat-middleware/utils"
+)
+
+const DEFAULT_COOKIE_NAME = "lsat"
+
+// CookieConfig makes the middleware accept the LSAT from a cookie when the
+// request has no Authorization header, so plain <img> and <a> tags work.
+// The cookie is always HttpOnly and its value is "<macaroon>:<preimage>".
+type CookieConfig struct {
+	// Name of the cookie, DEFAULT_COOKIE_NAME if empty
+	Name   string
+	Path   string
+	Domain string
+	// MaxAge in seconds, 0 makes it a session cookie
+	MaxAge   int
+	SameSite http.SameSite
+	// Insecure drops the Secure attribute, for development over plain HTTP
+	Insecure bool
+}
+
+func (cookieConfig *CookieConfig) name() string {
+	if cookieConfig.Name == "" {
+		return DEFAULT_COOKIE_NAME
+	}
+	return cookieConfig.Name
+}
+
+func (cookieConfig *CookieConfig) newCookie(value string, maxAge int) *http.Cookie {
+	path := cookieConfig.Path
+	if path == "" {
+		path = "/"
+	}
+	sameSite := cookieConfig.SameSite
+	if sameSite == 0 {
+		sameSite = http.SameSiteLaxMode
+	}
+	return &http.Cookie{
+		Name:     cookieConfig.name(),
+		Value:    value,
+		Path:     path,
+		Domain:   cookieConfig.Domain,
+		MaxAge:   maxAge,
+		Secure:   !cookieConfig.Insecure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	}
+}
+
+// getAuthField returns the Authorization header, falling back to the LSAT
+// cookie if one is configured.
+func (lsatMiddleware *LsatMiddleware) getAuthField(req *http.Request) string {
+	authField := req.Header.Get("Authorization")
+	if authField != "" || lsatMiddleware.Cookie == nil {
+		return authField
+	}
+	cookie, err := req.Cookie(lsatMiddleware.Cookie.name())
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	return lsat.LSAT_HEADER + " " + cookie.Value
+}
+
+// SetLsatCookie verifies the LSAT in authField and stores it in the cookie,
+// along with the discharges of its third-party caveats. Route caveats are
+// checked on every later request, so only the signature, expiry and preimage
+// are verified here.
+func (lsatMiddleware *LsatMiddleware) SetLsatCookie(w http.ResponseWriter, authField string) error {
+	mac, discharges, preimage, err := utils.ParseLsatHeaderWithDischarges(authField)
+	if err != nil {
+		return err
+	}
+	if err := lsat.VerifyLSATWithDischarges(context.Background(), mac, discharges, nil, lsatMiddleware.RootKey, preimage); err != nil {
+		return err
+	}
+	cookieConfig := lsatMiddleware.Cookie
+	if cookieConfig == nil {
+		cookieConfig = &CookieConfig{}
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(authField), lsat.LSAT_HEADER+" "))
+	http.SetCookie(w, cookieConfig.newCookie(token, cookieConfig.MaxAge))
+	return nil
+}
+
+func (lsatMiddleware *LsatMiddleware) ClearLsatCookie(w http.ResponseWriter) {
+	cookieConfig := lsatMiddleware.Cookie
+	if cookieConfig == nil {
+		cookieConfig = &CookieConfig{}
+	}
+	http.SetCookie(w, cookieConfig.newCookie("", -1))
+}
+
+// CookieHandler stores the LSAT sent in the Authorization header of a POST
+// request in the cookie, and clears the cookie on DELETE.
+func (lsatMiddleware *LsatMiddleware) CookieHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		if err := lsatMiddleware.SetLsatCookie(w, req.Header.Get("Authorization")); err != nil {
+			lsatMiddleware.Render(w, req, &Response{
+				Status:  http.StatusUnauthorized,
+				Message: err.Error(),
+				Error:   err,
+			})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		lsatMiddleware.ClearLsatCookie(w)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/lsat"
+)
+
+// Hook is called by the middleware at the points of a request's lifecycle
+// named by the LsatMiddleware fields it is assigned to. Hooks run
+// synchronously on the request's goroutine, so they should be quick.
+type Hook func(req *http.Request, lsatInfo *lsat.LsatInfo, metadata *HookMetadata)
+
+type HookMetadata struct {
+	// Caveats the LSAT was verified against, or the challenge minted with
+	Caveats []caveat.Caveat
+	// Challenge is set for OnInvoiceCreated and OnChallenge
+	Challenge *Challenge
+	// Duration of the AddInvoice call, set for OnInvoiceCreated
+	Duration time.Duration
+	// Pooled is set for OnInvoiceCreated if the invoice was taken from
+	// InvoicePool, Duration is then zero
+	Pooled bool
+}
+
+func runHook(hook Hook, req *http.Request, lsatInfo *lsat.LsatInfo, metadata *HookMetadata) {
+	if hook != nil {
+		hook(req, lsatInfo, metadata)
+	}
+}
+
+// MarkFree returns the LsatInfo of a request served as free content and
+// runs OnFree.
+func (lsatMiddleware *LsatMiddleware) MarkFree(req *http.Request) *lsat.LsatInfo {
+	lsatInfo := &lsat.LsatInfo{
+		Type: lsat.LSAT_TYPE_FREE,
+	}
+	runHook(lsatMiddleware.OnFree, req, lsatInfo, &HookMetadata{})
+	return lsatInfo
+}
+
+// WriteChallenge sends the 402 response for challenge and runs OnChallenge.
+func (lsatMiddleware *LsatMiddleware) WriteChallenge(w http.ResponseWriter, req *http.Request, lsatInfo *lsat.LsatInfo, challenge *Challenge) {
+	w.Header().Set("WWW-Authenticate", challenge.Header())
+	lsatMiddleware.Render(w, req, &Response{
+		Status:    http.StatusPaymentRequired,
+		Message:   lsat.PAYMENT_REQUIRED_MESSAGE,
+		Challenge: challenge,
+	})
+	runHook(lsatMiddleware.OnChallenge, req, lsatInfo, &HookMetadata{
+		Caveats:   challenge.Caveats,
+		Challenge: challenge,
+	})
+}
@@ -1,19 +1,143 @@
 package middleware
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/getAlby/lsat-middleware/caveat"
 	"github.com/getAlby/lsat-middleware/ln"
+	"github.com/getAlby/lsat-middleware/logging"
+	"github.com/getAlby/lsat-middleware/lsat"
+	macaroonutils "github.com/getAlby/lsat-middleware/macaroon"
+	"github.com/getAlby/lsat-middleware/tier"
+	"github.com/getAlby/lsat-middleware/tracing"
+	"github.com/getAlby/lsat-middleware/utils"
+	"github.com/getAlby/lsat-middleware/webhook"
+
+	decodepay "github.com/fiatjaf/ln-decodepay"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/macaroon.v2"
 )
 
+// INVOICE_MEMO is the memo of the invoices created for challenges
+const INVOICE_MEMO = "LSAT"
+
 type amountFunc func(*http.Request) int64
+type amountMsatFunc func(*http.Request) (lnwire.MilliSatoshi, error)
 type caveatFunc func(*http.Request) []caveat.Caveat
+type caveatsFunc func(*http.Request) ([]caveat.Caveat, error)
+type requirementFunc func(*http.Request) *tier.Requirement
 type LsatMiddleware struct {
 	AmountFunc amountFunc
-	LNClient   ln.LNClient
-	CaveatFunc caveatFunc
-	RootKey    []byte
+	// AmountMsatFunc prices requests in msat and takes precedence over
+	// AmountFunc. Requests it fails to price are rejected with ErrPricing.
+	AmountMsatFunc amountMsatFunc
+	LNClient       ln.LNClient
+	CaveatFunc     caveatFunc
+	// CaveatsFunc takes precedence over CaveatFunc and may fail, which
+	// rejects the request
+	CaveatsFunc caveatsFunc
+	// RequestCaveats are minted into every LSAT and checked against the
+	// requests presenting it, see caveat.RequestCaveat
+	RequestCaveats []caveat.RequestCaveat
+	RootKey        []byte
+	// RequirementFunc returns the service tier and capabilities a route
+	// requires, nil if it requires none. LSATs for those routes are bought
+	// for the lowest of Tiers covering the requirement.
+	RequirementFunc requirementFunc
+	Tiers           []tier.Tier
+	// ThirdPartyCaveats are added to every LSAT, which is then only accepted
+	// with discharges from their dischargers, see lsat.Discharge
+	ThirdPartyCaveats []caveat.ThirdPartyCaveat
+	// ResponseRenderer renders challenges and errors, JSONRenderer if nil
+	ResponseRenderer ResponseRenderer
+	// Cookie, if set, lets browsers present the LSAT in a cookie
+	Cookie *CookieConfig
+	// StatusPollInterval is how often StatusHandler looks up a pending
+	// invoice, DEFAULT_STATUS_POLL_INTERVAL if zero
+	StatusPollInterval time.Duration
+	// StatusWaiters caps the status requests held waiting for a payment at
+	// once, uncapped if nil. NewLsatMiddleware sets it to
+	// DEFAULT_MAX_STATUS_WAITERS.
+	StatusWaiters *InvoiceLimiter
+	// InvoiceStore, if set, is filled by SubscribeInvoices and consulted
+	// before looking up invoices with the LN client
+	InvoiceStore ln.InvoiceStore
+	// UsageStore counts the uses of LSATs with max_uses caveats, which are
+	// rejected if nil
+	UsageStore UsageStore
+	// Ledger, if set, turns LSATs into prepaid balances. Each request is
+	// debited its price, and LSATs running out of balance are topped up
+	// keeping their token ID.
+	Ledger Ledger
+	// TopUpMsat is the credit bought with an LSAT when there is a Ledger,
+	// the price of the request if higher
+	TopUpMsat lnwire.MilliSatoshi
+	// PlanFunc returns the name of the plan of Plans LSATs for a request
+	// are sold for, "" for none. Those LSATs expire after the plan period
+	// unless renewed, see RenewalHandler.
+	PlanFunc planFunc
+	Plans    []Plan
+	// Subscriptions records renewals, expired subscription LSATs are
+	// rejected if nil
+	Subscriptions SubscriptionStore
+	// FreeQuota, if set, serves requests without an LSAT for free until
+	// their client runs out of free requests, see AllowFree
+	FreeQuota *FreeQuota
+	// ChallengeRateLimit, ChallengeReuse and InvoiceLimiter, if set, keep
+	// clients from flooding the node with invoices
+	ChallengeRateLimit *ChallengeRateLimit
+	ChallengeReuse     *ChallengeReuse
+	InvoiceLimiter     *InvoiceLimiter
+	// InvoicePool, if set, serves challenges for its prices from invoices
+	// created ahead of time, see RunInvoicePool
+	InvoicePool *InvoicePool
+	// Webhooks, if set, is notified of invoices and tokens
+	Webhooks *webhook.Dispatcher
+
+	// Logger receives decisions and backend errors, with secrets redacted.
+	// Nothing is logged if nil.
+	Logger *slog.Logger
+	// loggers keeps the redacting wrapper of Logger, so that it isn't built
+	// on every log call. Set by NewLsatMiddleware.
+	loggers *loggerCache
+
+	// Lifecycle hooks, see Hook
+	OnChallenge      Hook
+	OnInvoiceCreated Hook
+	OnVerified       Hook
+	OnRejected       Hook
+	OnFree           Hook
+}
+
+// Challenge holds what a client needs to pay for and later present an LSAT.
+type Challenge struct {
+	Macaroon    string
+	Invoice     string
+	PaymentHash lntypes.Hash
+	Amount      int64
+	AmountMsat  lnwire.MilliSatoshi
+	ExpiresAt   time.Time
+	Caveats     []caveat.Caveat
+	// Upgrade is set if the macaroon upgrades the LSAT of the request to a
+	// higher tier, keeping its token ID
+	Upgrade bool
+	// TopUp is set if the macaroon adds to the balance of the LSAT of the
+	// request, keeping its token ID
+	TopUp bool
+	// Renewal is set if the macaroon renews the subscription LSAT of the
+	// request, see RenewalHandler
+	Renewal bool
 }
 
 func NewLsatMiddleware(lnClientConfig *ln.LNClientConfig,
@@ -27,6 +151,477 @@ func NewLsatMiddleware(lnClientConfig *ln.LNClientConfig,
 		LNClient:   lnClient,
 		CaveatFunc: caveatF,
 		RootKey:    lnClientConfig.RootKey,
+		// Waiting status requests each hold a connection and poll the node
+		StatusWaiters: NewInvoiceLimiter(DEFAULT_MAX_STATUS_WAITERS, 0),
+		loggers:       &loggerCache{},
 	}
 	return middleware, nil
 }
+
+// GetCaveats returns the caveats an LSAT for req has to carry, from
+// CaveatsFunc or CaveatFunc. Errors wrap ErrCaveats.
+func (lsatMiddleware *LsatMiddleware) GetCaveats(req *http.Request) ([]caveat.Caveat, error) {
+	switch {
+	case lsatMiddleware.CaveatsFunc != nil:
+		caveats, err := lsatMiddleware.CaveatsFunc(req)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", lsat.ErrCaveats, err.Error())
+		}
+		return caveats, nil
+	case lsatMiddleware.CaveatFunc != nil:
+		return lsatMiddleware.CaveatFunc(req), nil
+	default:
+		return []caveat.Caveat{}, nil
+	}
+}
+
+// VerifyRequest checks the Authorization header (or LSAT cookie) of req against caveats.
+// A request without Authorization header is reported as LSAT_TYPE_FREE,
+// one whose header can't be parsed as LSAT_TYPE_ERROR with ErrMalformedToken.
+func (lsatMiddleware *LsatMiddleware) VerifyRequest(req *http.Request, caveats []caveat.Caveat) *lsat.LsatInfo {
+	ctx, span := tracing.Tracer().Start(req.Context(), "lsat.VerifyRequest",
+		trace.WithAttributes(tracing.ATTRIBUTE_ROUTE.String(req.URL.Path)))
+	lsatInfo := lsatMiddleware.verifyRequest(ctx, req, caveats)
+	span.SetAttributes(attribute.String("lsat.type", lsatInfo.Type))
+	tracing.RecordReason(span, lsat.ErrorReason(lsatInfo.Error), lsatInfo.Error)
+	span.End()
+	lsatMiddleware.logVerification(ctx, req, lsatInfo)
+	lsatMiddleware.notifyVerification(req, lsatInfo)
+	switch lsatInfo.Type {
+	case lsat.LSAT_TYPE_PAID:
+		runHook(lsatMiddleware.OnVerified, req, lsatInfo, &HookMetadata{Caveats: caveats})
+	case lsat.LSAT_TYPE_ERROR:
+		runHook(lsatMiddleware.OnRejected, req, lsatInfo, &HookMetadata{Caveats: caveats})
+	}
+	return lsatInfo
+}
+
+func (lsatMiddleware *LsatMiddleware) verifyRequest(ctx context.Context, req *http.Request, caveats []caveat.Caveat) *lsat.LsatInfo {
+	authField := lsatMiddleware.getAuthField(req)
+	if authField == "" {
+		return &lsat.LsatInfo{
+			Type: lsat.LSAT_TYPE_FREE,
+		}
+	}
+	_, parseSpan := tracing.Tracer().Start(ctx, "lsat.ParseLsatHeader")
+	mac, discharges, preimage, err := utils.ParseLsatHeaderWithDischarges(authField)
+	tracing.RecordReason(parseSpan, lsat.REASON_MALFORMED, err)
+	parseSpan.End()
+	if err != nil {
+		return &lsat.LsatInfo{
+			Type:  lsat.LSAT_TYPE_ERROR,
+			Error: fmt.Errorf("%w: %s", lsat.ErrMalformedToken, err.Error()),
+		}
+	}
+	err = lsat.VerifyLSATWithDischarges(ctx, mac, discharges, caveats, lsatMiddleware.RootKey, preimage)
+	if errors.Is(err, lsat.ErrExpired) && lsatMiddleware.Subscriptions != nil {
+		err = lsatMiddleware.verifySubscription(ctx, mac, discharges, caveats, preimage)
+	}
+	if err != nil {
+		return &lsat.LsatInfo{
+			Type:  lsat.LSAT_TYPE_ERROR,
+			Error: err,
+		}
+	}
+	lsatInfo, err := lsat.GetPaidLsatInfo(mac, preimage)
+	if err != nil {
+		return &lsat.LsatInfo{
+			Type:  lsat.LSAT_TYPE_ERROR,
+			Error: err,
+		}
+	}
+	if lsatMiddleware.ChallengeReuse != nil {
+		// The invoice is paid, its challenge can't be handed out again
+		lsatMiddleware.ChallengeReuse.Forget(lsatInfo.PaymentHash)
+	}
+	if err := checkNotRenewal(lsatInfo.Caveats); err != nil {
+		return &lsat.LsatInfo{
+			Type:  lsat.LSAT_TYPE_ERROR,
+			Error: err,
+		}
+	}
+	if err := caveat.Satisfy(lsatInfo.Caveats, lsatMiddleware.RequestCaveats, req); err != nil {
+		return &lsat.LsatInfo{
+			Type:  lsat.LSAT_TYPE_ERROR,
+			Error: fmt.Errorf("%w: %s", lsat.ErrCaveatMismatch, err.Error()),
+		}
+	}
+	if requirement := lsatMiddleware.requirement(req); requirement != nil {
+		if err := tier.Check(lsatInfo.Caveats, requirement); err != nil {
+			// Keep describing the LSAT, CreateChallenge offers to upgrade it
+			lsatInfo.Type = lsat.LSAT_TYPE_ERROR
+			lsatInfo.Error = fmt.Errorf("%w: %s", lsat.ErrInsufficientTier, err.Error())
+			return lsatInfo
+		}
+	}
+	undoUses, err := lsatMiddleware.checkUses(ctx, mac)
+	if err != nil {
+		return &lsat.LsatInfo{
+			Type:  lsat.LSAT_TYPE_ERROR,
+			Error: err,
+		}
+	}
+	if lsatMiddleware.Ledger != nil {
+		if err := lsatMiddleware.debit(ctx, req, lsatInfo); err != nil {
+			// The request isn't served, so it doesn't count as a use
+			undoUses()
+			// Keep describing the LSAT, CreateChallenge offers to top it up
+			lsatInfo.Type = lsat.LSAT_TYPE_ERROR
+			lsatInfo.Error = err
+			return lsatInfo
+		}
+	}
+	return lsatInfo
+}
+
+// CreateChallenge generates an invoice priced by AmountMsatFunc or AmountFunc and mints a
+// macaroon bound to its payment hash. lsatInfo describes the LSAT the
+// request came with, if any, and is passed on to OnInvoiceCreated. An LSAT
+// rejected for its tier is upgraded: the invoice is for the price
+// difference to the tier of the route and the macaroon keeps its token ID.
+// With a Ledger, an LSAT out of balance is topped up keeping its token ID.
+// LSATs for routes with a plan are subscriptions, valid for its period.
+// With ChallengeReuse, the recent unpaid challenge of the client for the
+// same route is returned instead of creating another invoice.
+func (lsatMiddleware *LsatMiddleware) CreateChallenge(ctx context.Context, req *http.Request, lsatInfo *lsat.LsatInfo, caveats []caveat.Caveat) (*Challenge, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "lsat.CreateChallenge", trace.WithAttributes(
+		tracing.ATTRIBUTE_ROUTE.String(req.URL.Path),
+		tracing.ATTRIBUTE_BACKEND.String(ln.ClientType(lsatMiddleware.LNClient)),
+	))
+	defer span.End()
+	caveats = append([]caveat.Caveat{}, caveats...)
+	var selectedTier, heldTier *tier.Tier
+	topUp := lsatMiddleware.canTopUp(lsatInfo)
+	if topUp {
+		// The LSAT already covers the route, only its balance is renewed
+		caveats = append(caveats, carryCaveats(lsatInfo, caveats)...)
+	} else if requirement := lsatMiddleware.requirement(req); requirement != nil {
+		var err error
+		selectedTier, err = tier.Select(lsatMiddleware.Tiers, requirement)
+		if err != nil {
+			err = fmt.Errorf("%w: %s", lsat.ErrCaveats, err.Error())
+			tracing.RecordError(span, err)
+			return nil, err
+		}
+		if held, ok := lsatMiddleware.upgradableFrom(lsatInfo, selectedTier); ok {
+			heldTier = held
+			caveats = append(caveats, upgradeCaveats(lsatInfo, held.Service, caveats)...)
+		}
+		caveats = append(caveats, selectedTier.Caveats()...)
+	}
+	var plan *Plan
+	if !topUp && heldTier == nil {
+		if plan = lsatMiddleware.plan(req); plan != nil {
+			caveats = append(caveats, planCaveats(plan)...)
+		}
+	}
+	var amountMsat lnwire.MilliSatoshi
+	var err error
+	switch {
+	case heldTier != nil:
+		amountMsat = lnwire.MilliSatoshi((selectedTier.Price - heldTier.Price) * ln.MSAT_PER_SAT)
+	case plan != nil:
+		amountMsat, err = lsatMiddleware.planAmountMsat(req, plan)
+	case selectedTier != nil && selectedTier.Price > 0:
+		amountMsat = lnwire.MilliSatoshi(selectedTier.Price * ln.MSAT_PER_SAT)
+	default:
+		amountMsat, err = lsatMiddleware.amountMsat(req)
+	}
+	if lsatMiddleware.Ledger != nil && lsatMiddleware.TopUpMsat > amountMsat {
+		amountMsat = lsatMiddleware.TopUpMsat
+	}
+	if err != nil {
+		lsatMiddleware.logger().ErrorContext(ctx, "Failed to price request",
+			slog.String("path", req.URL.Path),
+			slog.Any("error", err))
+		err = fmt.Errorf("%w: %s", lsat.ErrPricing, err.Error())
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	span.SetAttributes(tracing.ATTRIBUTE_AMOUNT_MSAT.Int64(int64(amountMsat)))
+	requestCaveats, err := caveat.Mint(lsatMiddleware.RequestCaveats, req)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", lsat.ErrCaveats, err.Error())
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	caveats = append(caveats, requestCaveats...)
+	var tokenId *[32]byte
+	if heldTier != nil || topUp {
+		tokenId = &lsatInfo.TokenId
+	}
+	var reuseKey string
+	if tokenId == nil && lsatMiddleware.ChallengeReuse != nil {
+		reuseKey = lsatMiddleware.ChallengeReuse.reuseKey(req, amountMsat, caveats)
+	}
+	if reuseKey != "" {
+		if challenge := lsatMiddleware.reusableChallenge(ctx, reuseKey); challenge != nil {
+			span.SetAttributes(attribute.Bool("lsat.challenge_reused", true))
+			return challenge, nil
+		}
+	}
+	challenge, err := lsatMiddleware.issueChallenge(ctx, req, lsatInfo, tokenId, &Challenge{
+		AmountMsat: amountMsat,
+		Caveats:    caveats,
+		Upgrade:    heldTier != nil,
+		TopUp:      topUp,
+	})
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	if reuseKey != "" {
+		lsatMiddleware.ChallengeReuse.put(reuseKey, challenge)
+	}
+	return challenge, nil
+}
+
+// issueChallenge completes challenge for its AmountMsat and Caveats with an
+// invoice and a macaroon bound to it, with tokenId if not nil. It counts
+// against ChallengeRateLimit.
+func (lsatMiddleware *LsatMiddleware) issueChallenge(ctx context.Context, req *http.Request, lsatInfo *lsat.LsatInfo, tokenId *[32]byte, challenge *Challenge) (*Challenge, error) {
+	amountMsat, caveats := challenge.AmountMsat, challenge.Caveats
+	if err := lsatMiddleware.checkRateLimit(ctx, req); err != nil {
+		return nil, err
+	}
+	invoice, paymentHash, duration, pooled, err := lsatMiddleware.generateInvoice(ctx, req, amountMsat)
+	if err != nil {
+		return nil, err
+	}
+	var mac *macaroon.Macaroon
+	if tokenId != nil {
+		mac, err = macaroonutils.NewMacaroonWithTokenId(*tokenId, paymentHash, amountMsat, caveats, lsatMiddleware.ThirdPartyCaveats, lsatMiddleware.RootKey)
+	} else {
+		mac, err = macaroonutils.NewMacaroon(paymentHash, amountMsat, caveats, lsatMiddleware.ThirdPartyCaveats, lsatMiddleware.RootKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	macaroonString, err := macaroonutils.GetMacaroonString(mac)
+	if err != nil {
+		return nil, err
+	}
+	challenge.Macaroon = macaroonString
+	challenge.Invoice = invoice
+	challenge.PaymentHash = paymentHash
+	challenge.Amount = int64(amountMsat.ToSatoshis())
+	// The expiry is informational only, don't fail the challenge over it
+	if decoded, err := decodepay.Decodepay(invoice); err == nil {
+		challenge.ExpiresAt = time.Unix(int64(decoded.CreatedAt+decoded.Expiry), 0)
+	}
+	if lsatMiddleware.Webhooks != nil {
+		lsatMiddleware.Webhooks.Send(webhook.EVENT_INVOICE_CREATED, map[string]interface{}{
+			"payment_hash": paymentHash.String(),
+			"invoice":      invoice,
+			"amount":       challenge.Amount,
+			"amount_msat":  challenge.AmountMsat,
+			"method":       req.Method,
+			"path":         req.URL.Path,
+		})
+	}
+	lsatMiddleware.logger().DebugContext(ctx, "Challenge created",
+		slog.String("path", req.URL.Path),
+		slog.String("payment_hash", paymentHash.String()),
+		slog.Int64("amount_msat", int64(challenge.AmountMsat)),
+		slog.Duration("duration", duration))
+	runHook(lsatMiddleware.OnInvoiceCreated, req, lsatInfo, &HookMetadata{
+		Caveats:   caveats,
+		Challenge: challenge,
+		Duration:  duration,
+		Pooled:    pooled,
+	})
+	return challenge, nil
+}
+
+// generateInvoice takes an invoice for amountMsat from InvoicePool, or
+// creates one with the LN client within InvoiceLimiter. It returns how long
+// creating it took, and whether it was pooled.
+func (lsatMiddleware *LsatMiddleware) generateInvoice(ctx context.Context, req *http.Request, amountMsat lnwire.MilliSatoshi) (string, lntypes.Hash, time.Duration, bool, error) {
+	if lsatMiddleware.InvoicePool != nil {
+		if pooled, ok := lsatMiddleware.InvoicePool.take(amountMsat); ok {
+			return pooled.invoice, pooled.paymentHash, 0, true, nil
+		}
+	}
+	if lsatMiddleware.InvoiceLimiter != nil {
+		release, err := lsatMiddleware.InvoiceLimiter.acquire(ctx)
+		if err != nil {
+			lsatMiddleware.logger().WarnContext(ctx, "Too many invoices being created", slog.String("path", req.URL.Path))
+			return "", lntypes.Hash{}, 0, false, err
+		}
+		defer release()
+	}
+	lnInvoice := &lnrpc.Invoice{
+		ValueMsat: int64(amountMsat),
+		Memo:      INVOICE_MEMO,
+	}
+	LNClientConn := &ln.LNClientConn{
+		LNClient: lsatMiddleware.LNClient,
+	}
+	start := time.Now()
+	invoice, paymentHash, err := LNClientConn.GenerateInvoice(ctx, lnInvoice, req)
+	duration := time.Since(start)
+	if err != nil {
+		lsatMiddleware.logger().ErrorContext(ctx, "Failed to create invoice",
+			slog.String("path", req.URL.Path),
+			slog.String("backend", ln.ClientType(lsatMiddleware.LNClient)),
+			slog.Int64("amount_msat", int64(amountMsat)),
+			slog.Any("error", err))
+		return "", lntypes.Hash{}, duration, false, fmt.Errorf("%w: %s", lsat.ErrInvoiceCreation, err.Error())
+	}
+	return invoice, paymentHash, duration, false, nil
+}
+
+func (challenge *Challenge) Header() string {
+	return fmt.Sprintf("LSAT macaroon=%s, invoice=%s", challenge.Macaroon, challenge.Invoice)
+}
+
+func (lsatMiddleware *LsatMiddleware) Render(w http.ResponseWriter, req *http.Request, response *Response) error {
+	renderer := lsatMiddleware.ResponseRenderer
+	if renderer == nil {
+		renderer = &JSONRenderer{}
+	}
+	return renderer.Render(w, req, response)
+}
+
+// SubscribeInvoices records the updates of the invoices created for
+// challenges into InvoiceStore until ctx is done. onUpdate may be nil.
+// It blocks, so run it in its own goroutine.
+func (lsatMiddleware *LsatMiddleware) SubscribeInvoices(ctx context.Context, onUpdate func(*ln.InvoiceState)) error {
+	subscriptionClient, ok := lsatMiddleware.LNClient.(ln.InvoiceSubscriptionClient)
+	if !ok {
+		return ln.ErrInvoiceSubscriptionUnsupported
+	}
+	if lsatMiddleware.InvoiceStore == nil {
+		return fmt.Errorf("InvoiceStore is required to subscribe to invoices")
+	}
+	subscriber := &ln.InvoiceSubscriber{
+		Store: lsatMiddleware.InvoiceStore,
+		Filter: func(invoice *lnrpc.Invoice) bool {
+			return invoice.Memo == INVOICE_MEMO
+		},
+		OnError: func(err error) {
+			lsatMiddleware.logger().WarnContext(ctx, "Invoice subscription failed, resubscribing", slog.Any("error", err))
+		},
+		OnUpdate: func(invoiceState *ln.InvoiceState) {
+			if invoiceState.IsSettled() && lsatMiddleware.Webhooks != nil {
+				lsatMiddleware.Webhooks.Send(webhook.EVENT_INVOICE_SETTLED, map[string]interface{}{
+					"payment_hash":     invoiceState.PaymentHash.String(),
+					"amount_paid_msat": invoiceState.AmountPaidMsat,
+					"settled_at":       invoiceState.SettledAt.UTC(),
+				})
+			}
+			if onUpdate != nil {
+				onUpdate(invoiceState)
+			}
+		},
+	}
+	return subscriber.Run(ctx, subscriptionClient)
+}
+
+func (lsatMiddleware *LsatMiddleware) requirement(req *http.Request) *tier.Requirement {
+	if lsatMiddleware.RequirementFunc == nil {
+		return nil
+	}
+	return lsatMiddleware.RequirementFunc(req)
+}
+
+func (lsatMiddleware *LsatMiddleware) amountMsat(req *http.Request) (lnwire.MilliSatoshi, error) {
+	var amountMsat lnwire.MilliSatoshi
+	switch {
+	case lsatMiddleware.AmountMsatFunc != nil:
+		var err error
+		amountMsat, err = lsatMiddleware.AmountMsatFunc(req)
+		if err != nil {
+			return 0, err
+		}
+	case lsatMiddleware.AmountFunc != nil:
+		amountMsat = lnwire.MilliSatoshi(lsatMiddleware.AmountFunc(req) * ln.MSAT_PER_SAT)
+	default:
+		return 0, fmt.Errorf("No AmountFunc configured")
+	}
+	// A zero amount invoice would let the client pick the price
+	if amountMsat == 0 {
+		return 0, fmt.Errorf("Amount must be positive")
+	}
+	return amountMsat, nil
+}
+
+// ChallengeErrorStatus is the HTTP status for an error of CreateChallenge.
+func ChallengeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, lsat.ErrPricing), errors.Is(err, lsat.ErrInvoiceCapacity):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, lsat.ErrRateLimited):
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+type loggerCache struct {
+	mu       sync.Mutex
+	source   *slog.Logger
+	redacted *slog.Logger
+}
+
+// get returns the redacting wrapper of logger, rebuilding it only if the
+// Logger was replaced since the last call.
+func (cache *loggerCache) get(logger *slog.Logger) *slog.Logger {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.redacted == nil || cache.source != logger {
+		cache.source, cache.redacted = logger, logging.Logger(logger)
+	}
+	return cache.redacted
+}
+
+func (lsatMiddleware *LsatMiddleware) logger() *slog.Logger {
+	if lsatMiddleware.loggers == nil {
+		return logging.Logger(lsatMiddleware.Logger)
+	}
+	return lsatMiddleware.loggers.get(lsatMiddleware.Logger)
+}
+
+// logVerification logs the outcome of a verification. Errors are logged by
+// reason only, as their messages may contain the token.
+func (lsatMiddleware *LsatMiddleware) logVerification(ctx context.Context, req *http.Request, lsatInfo *lsat.LsatInfo) {
+	switch lsatInfo.Type {
+	case lsat.LSAT_TYPE_PAID:
+		lsatMiddleware.logger().DebugContext(ctx, "LSAT verified",
+			slog.String("path", req.URL.Path),
+			slog.String("token_id", hex.EncodeToString(lsatInfo.TokenId[:])),
+			slog.String("payment_hash", lsatInfo.PaymentHash.String()))
+	case lsat.LSAT_TYPE_ERROR:
+		lsatMiddleware.logger().InfoContext(ctx, "LSAT rejected",
+			slog.String("path", req.URL.Path),
+			slog.String("reason", lsat.ErrorReason(lsatInfo.Error)))
+	}
+}
+
+// notifyVerification sends token webhooks. Like logs, rejections carry the
+// reason only.
+func (lsatMiddleware *LsatMiddleware) notifyVerification(req *http.Request, lsatInfo *lsat.LsatInfo) {
+	if lsatMiddleware.Webhooks == nil {
+		return
+	}
+	switch lsatInfo.Type {
+	case lsat.LSAT_TYPE_PAID:
+		tokenId := hex.EncodeToString(lsatInfo.TokenId[:])
+		if !lsatMiddleware.Webhooks.FirstUse(tokenId) {
+			return
+		}
+		lsatMiddleware.Webhooks.Send(webhook.EVENT_TOKEN_FIRST_USED, map[string]interface{}{
+			"token_id":     tokenId,
+			"payment_hash": lsatInfo.PaymentHash.String(),
+			"amount":       lsatInfo.Amount,
+			"amount_msat":  lsatInfo.AmountMsat,
+			"method":       req.Method,
+			"path":         req.URL.Path,
+		})
+	case lsat.LSAT_TYPE_ERROR:
+		lsatMiddleware.Webhooks.Send(webhook.EVENT_TOKEN_REJECTED, map[string]interface{}{
+			"reason": lsat.ErrorReason(lsatInfo.Error),
+			"method": req.Method,
+			"path":   req.URL.Path,
+		})
+	}
+}
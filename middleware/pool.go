@@ -0,0 +1,249 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/ln"
+
+	decodepay "github.com/fiatjaf/ln-decodepay"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+const (
+	DEFAULT_POOL_MIN_LIFETIME    = 10 * time.Minute
+	DEFAULT_POOL_REFILL_INTERVAL = time.Minute
+	// INVOICE_POOL_HEADER is set on the request LN clients are passed when
+	// creating pooled invoices, as there is no client request yet
+	INVOICE_POOL_HEADER = "X-Lsat-Invoice-Pool"
+)
+
+// InvoicePool keeps invoices created ahead of time for the prices of fixed
+// price routes, so that challenges for them don't wait for the node. The
+// macaroon is still minted for each challenge, and the invoice.created
+// webhook and OnInvoiceCreated hook run when a challenge takes an invoice.
+// RunInvoicePool fills it.
+type InvoicePool struct {
+	// AmountsMsat are the prices invoices are kept for
+	AmountsMsat []lnwire.MilliSatoshi
+	// Size is how many invoices are kept per price
+	Size int
+	// Concurrency is how many invoices are created at once, 1 if zero
+	Concurrency int
+	// MinLifetime is the time left before expiry under which invoices are
+	// discarded, DEFAULT_POOL_MIN_LIFETIME if zero
+	MinLifetime time.Duration
+	// RefillInterval is how often expiring invoices are replaced,
+	// DEFAULT_POOL_REFILL_INTERVAL if zero. Taken invoices are replaced
+	// right away.
+	RefillInterval time.Duration
+
+	mu       sync.Mutex
+	invoices map[lnwire.MilliSatoshi][]pooledInvoice
+	taken    chan struct{}
+}
+
+type pooledInvoice struct {
+	invoice     string
+	paymentHash lntypes.Hash
+	expiresAt   time.Time
+}
+
+func NewInvoicePool(size int, amountsMsat ...lnwire.MilliSatoshi) *InvoicePool {
+	return &InvoicePool{
+		AmountsMsat: amountsMsat,
+		Size:        size,
+	}
+}
+
+// lazyInit creates the state of pools that weren't made by NewInvoicePool.
+// pool.mu must be held.
+func (pool *InvoicePool) lazyInit() {
+	if pool.invoices == nil {
+		pool.invoices = make(map[lnwire.MilliSatoshi][]pooledInvoice)
+		pool.taken = make(chan struct{}, 1)
+	}
+}
+
+// takenSignal returns the channel signalling that an invoice was taken.
+func (pool *InvoicePool) takenSignal() <-chan struct{} {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.lazyInit()
+	return pool.taken
+}
+
+func (pool *InvoicePool) minLifetime() time.Duration {
+	if pool.MinLifetime > 0 {
+		return pool.MinLifetime
+	}
+	return DEFAULT_POOL_MIN_LIFETIME
+}
+
+// take hands out the pooled invoice for amountMsat expiring last, if any.
+func (pool *InvoicePool) take(amountMsat lnwire.MilliSatoshi) (pooledInvoice, bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.lazyInit()
+	pool.discardExpiring(amountMsat)
+	invoices := pool.invoices[amountMsat]
+	if len(invoices) == 0 {
+		return pooledInvoice{}, false
+	}
+	// Invoices are kept in order of expiry, the last one expires last
+	taken := invoices[len(invoices)-1]
+	pool.invoices[amountMsat] = invoices[:len(invoices)-1]
+	select {
+	case pool.taken <- struct{}{}:
+	default:
+	}
+	return taken, true
+}
+
+// Len returns how many invoices are pooled for amountMsat, not counting
+// expiring ones.
+func (pool *InvoicePool) Len(amountMsat lnwire.MilliSatoshi) int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.lazyInit()
+	pool.discardExpiring(amountMsat)
+	return len(pool.invoices[amountMsat])
+}
+
+func (pool *InvoicePool) discardExpiring(amountMsat lnwire.MilliSatoshi) {
+	deadline := time.Now().Add(pool.minLifetime())
+	invoices := pool.invoices[amountMsat]
+	first := 0
+	for first < len(invoices) && invoices[first].expiresAt.Before(deadline) {
+		first++
+	}
+	pool.invoices[amountMsat] = invoices[first:]
+}
+
+// missing returns how many invoices each price needs to be back to Size.
+func (pool *InvoicePool) missing() map[lnwire.MilliSatoshi]int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.lazyInit()
+	missing := map[lnwire.MilliSatoshi]int{}
+	for _, amountMsat := range pool.AmountsMsat {
+		pool.discardExpiring(amountMsat)
+		if n := pool.Size - len(pool.invoices[amountMsat]); n > 0 {
+			missing[amountMsat] = n
+		}
+	}
+	return missing
+}
+
+func (pool *InvoicePool) add(amountMsat lnwire.MilliSatoshi, invoice pooledInvoice) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.lazyInit()
+	invoices := pool.invoices[amountMsat]
+	// Keep the invoices ordered by expiry, refills finish in any order
+	i := len(invoices)
+	for i > 0 && invoices[i-1].expiresAt.After(invoice.expiresAt) {
+		i--
+	}
+	invoices = append(invoices, pooledInvoice{})
+	copy(invoices[i+1:], invoices[i:])
+	invoices[i] = invoice
+	pool.invoices[amountMsat] = invoices
+}
+
+// RunInvoicePool keeps InvoicePool filled until ctx is done. It blocks, so
+// run it in its own goroutine.
+func (lsatMiddleware *LsatMiddleware) RunInvoicePool(ctx context.Context) error {
+	pool := lsatMiddleware.InvoicePool
+	if pool == nil {
+		return fmt.Errorf("InvoicePool is required to pool invoices")
+	}
+	interval := pool.RefillInterval
+	if interval <= 0 {
+		interval = DEFAULT_POOL_REFILL_INTERVAL
+	}
+	taken := pool.takenSignal()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		lsatMiddleware.refillInvoicePool(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-taken:
+		}
+	}
+}
+
+// refillInvoicePool creates the missing invoices of the pool, Concurrency
+// at a time. Failures are logged and retried on the next refill.
+func (lsatMiddleware *LsatMiddleware) refillInvoicePool(ctx context.Context) {
+	pool := lsatMiddleware.InvoicePool
+	concurrency := pool.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for amountMsat, n := range pool.missing() {
+		for i := 0; i < n; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				wg.Wait()
+				return
+			}
+			wg.Add(1)
+			go func(amountMsat lnwire.MilliSatoshi) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				invoice, err := lsatMiddleware.createPooledInvoice(ctx, amountMsat)
+				if err != nil {
+					lsatMiddleware.logger().ErrorContext(ctx, "Failed to create pooled invoice",
+						slog.String("backend", ln.ClientType(lsatMiddleware.LNClient)),
+						slog.Int64("amount_msat", int64(amountMsat)),
+						slog.Any("error", err))
+					return
+				}
+				pool.add(amountMsat, invoice)
+			}(amountMsat)
+		}
+	}
+	wg.Wait()
+}
+
+func (lsatMiddleware *LsatMiddleware) createPooledInvoice(ctx context.Context, amountMsat lnwire.MilliSatoshi) (pooledInvoice, error) {
+	// LN clients may read the client request, which pooled invoices have none of
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		return pooledInvoice{}, err
+	}
+	req.Header.Set(INVOICE_POOL_HEADER, "1")
+	LNClientConn := &ln.LNClientConn{
+		LNClient: lsatMiddleware.LNClient,
+	}
+	invoice, paymentHash, err := LNClientConn.GenerateInvoice(ctx, &lnrpc.Invoice{
+		ValueMsat: int64(amountMsat),
+		Memo:      INVOICE_MEMO,
+	}, req)
+	if err != nil {
+		return pooledInvoice{}, err
+	}
+	// Invoices whose expiry is unknown can't be told apart from stale ones
+	decoded, err := decodepay.Decodepay(invoice)
+	if err != nil {
+		return pooledInvoice{}, err
+	}
+	return pooledInvoice{
+		invoice:     invoice,
+		paymentHash: paymentHash,
+		expiresAt:   time.Unix(int64(decoded.CreatedAt+decoded.Expiry), 0),
+	}, nil
+}
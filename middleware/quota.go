@@ -0,0 +1,189 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+)
+
+// FREE_REQUESTS_REMAINING_HEADER tells clients without an LSAT how many
+// free requests they have left.
+const FREE_REQUESTS_REMAINING_HEADER = "X-Free-Requests-Remaining"
+
+// QuotaLimit allows Requests free requests within any Window.
+type QuotaLimit struct {
+	Requests int64
+	Window   time.Duration
+}
+
+// QuotaTracker counts the requests of clients, see FreeQuota and
+// ChallengeRateLimit. Implementations must be
+// safe for concurrent use.
+type QuotaTracker interface {
+	// Allow records a request of key if it is within all limits and
+	// reports whether it did, with the requests key has left.
+	Allow(ctx context.Context, key string, limits []QuotaLimit) (bool, int64, error)
+}
+
+// FreeQuota lets clients without an LSAT make a few requests before they
+// are challenged.
+type FreeQuota struct {
+	Tracker QuotaTracker
+	Limits  []QuotaLimit
+	// KeyFunc returns the client a request counts against, "" for clients
+	// without free requests. ClientIPQuotaKey if nil.
+	KeyFunc func(*http.Request) string
+}
+
+// ClientIPQuotaKey counts requests by the address of the peer. Use a
+// KeyFunc reading a trusted proxy header when running behind a proxy.
+func ClientIPQuotaKey(req *http.Request) string {
+	addr, err := caveat.RemoteClientIP(req)
+	if err != nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func quotaKey(keyFunc func(*http.Request) string, req *http.Request) string {
+	if keyFunc == nil {
+		return ClientIPQuotaKey(req)
+	}
+	return keyFunc(req)
+}
+
+// HeaderQuotaKey counts requests by the value of header name, e.g. an API
+// key. Requests without it get no free requests.
+func HeaderQuotaKey(name string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		if value := req.Header.Get(name); value != "" {
+			return name + ":" + value
+		}
+		return ""
+	}
+}
+
+// SlidingWindowQuota tracks free requests in memory over sliding windows,
+// they are lost on restart. Clients idle for longer than every window are
+// forgotten.
+type SlidingWindowQuota struct {
+	mu       sync.Mutex
+	requests map[string][]time.Time
+	// longest is the longest window seen, clients are swept once per
+	// longest window
+	longest   time.Duration
+	lastSweep time.Time
+}
+
+func NewSlidingWindowQuota() *SlidingWindowQuota {
+	return &SlidingWindowQuota{
+		requests: make(map[string][]time.Time),
+	}
+}
+
+func (quota *SlidingWindowQuota) Allow(ctx context.Context, key string, limits []QuotaLimit) (bool, int64, error) {
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	now := time.Now()
+	var longest time.Duration
+	for _, limit := range limits {
+		if limit.Window > longest {
+			longest = limit.Window
+		}
+	}
+	// Requests are in order, drop those older than every window
+	requests := quota.requests[key]
+	first := 0
+	for first < len(requests) && now.Sub(requests[first]) >= longest {
+		first++
+	}
+	requests = requests[first:]
+	allowed, remaining := quotaRemaining(requests, limits, now)
+	if allowed {
+		requests = append(requests, now)
+		remaining--
+	}
+	if len(requests) == 0 {
+		delete(quota.requests, key)
+	} else {
+		quota.requests[key] = requests
+	}
+	if longest > quota.longest {
+		quota.longest = longest
+	}
+	if now.Sub(quota.lastSweep) >= quota.longest {
+		quota.sweep(now)
+	}
+	return allowed, remaining, nil
+}
+
+// Len returns how many clients are tracked.
+func (quota *SlidingWindowQuota) Len() int {
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	return len(quota.requests)
+}
+
+// sweep forgets the clients whose last request is older than every window.
+func (quota *SlidingWindowQuota) sweep(now time.Time) {
+	quota.lastSweep = now
+	for key, requests := range quota.requests {
+		if now.Sub(requests[len(requests)-1]) >= quota.longest {
+			delete(quota.requests, key)
+		}
+	}
+}
+
+// quotaRemaining returns whether requests leave room under all limits and
+// the requests left under the tightest.
+func quotaRemaining(requests []time.Time, limits []QuotaLimit, now time.Time) (bool, int64) {
+	allowed, remaining := len(limits) > 0, int64(-1)
+	for _, limit := range limits {
+		count := int64(0)
+		for _, t := range requests {
+			if now.Sub(t) < limit.Window {
+				count++
+			}
+		}
+		left := limit.Requests - count
+		if left <= 0 {
+			allowed, left = false, 0
+		}
+		if remaining < 0 || left < remaining {
+			remaining = left
+		}
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return allowed, remaining
+}
+
+// AllowFree consults FreeQuota for a request without LSAT that would be
+// challenged, and reports whether it is served for free instead. It sets
+// X-Free-Requests-Remaining on w in either case. Requests are challenged
+// if the quota can't be checked.
+func (lsatMiddleware *LsatMiddleware) AllowFree(w http.ResponseWriter, req *http.Request) bool {
+	quota := lsatMiddleware.FreeQuota
+	if quota == nil || quota.Tracker == nil {
+		return false
+	}
+	key := quotaKey(quota.KeyFunc, req)
+	if key == "" {
+		return false
+	}
+	allowed, remaining, err := quota.Tracker.Allow(req.Context(), key, quota.Limits)
+	if err != nil {
+		lsatMiddleware.logger().ErrorContext(req.Context(), "Failed to check free quota",
+			slog.String("path", req.URL.Path),
+			slog.Any("error", err))
+		return false
+	}
+	w.Header().Set(FREE_REQUESTS_REMAINING_HEADER, strconv.FormatInt(remaining, 10))
+	return allowed
+}
@@ -0,0 +1,271 @@
+package middleware
+
+import (
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/ln"
+	"github.com/getAlby/lsat-middleware/lsat"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// ChallengeRateLimit limits how many challenges, each creating an invoice,
+// a client is issued. Challenges over the limits fail with ErrRateLimited.
+type ChallengeRateLimit struct {
+	Tracker QuotaTracker
+	Limits  []QuotaLimit
+	// KeyFunc returns the client a challenge counts against, "" for
+	// clients that aren't limited. ClientIPQuotaKey if nil.
+	KeyFunc func(*http.Request) string
+}
+
+// checkRateLimit counts a challenge for req against ChallengeRateLimit.
+// Challenges are issued if the limit can't be checked, as failing them
+// would take the paywall down with the tracker.
+func (lsatMiddleware *LsatMiddleware) checkRateLimit(ctx context.Context, req *http.Request) error {
+	limit := lsatMiddleware.ChallengeRateLimit
+	if limit == nil || limit.Tracker == nil {
+		return nil
+	}
+	key := quotaKey(limit.KeyFunc, req)
+	if key == "" {
+		return nil
+	}
+	allowed, _, err := limit.Tracker.Allow(ctx, key, limit.Limits)
+	if err != nil {
+		lsatMiddleware.logger().ErrorContext(ctx, "Failed to check challenge rate limit",
+			slog.String("path", req.URL.Path),
+			slog.Any("error", err))
+		return nil
+	}
+	if !allowed {
+		lsatMiddleware.logger().DebugContext(ctx, "Challenge rate limited", slog.String("path", req.URL.Path))
+		return lsat.ErrRateLimited
+	}
+	return nil
+}
+
+// InvoiceLimiter caps the invoices being created at once across all
+// requests. Share one between middlewares talking to the same node. Its
+// fields must be set before first use.
+type InvoiceLimiter struct {
+	// MaxInFlight is how many invoices are created at once, uncapped if
+	// zero
+	MaxInFlight int
+	// Wait is how long a challenge waits for a slot before failing with
+	// ErrInvoiceCapacity, it fails right away if zero
+	Wait time.Duration
+
+	once  sync.Once
+	slots chan struct{}
+}
+
+func NewInvoiceLimiter(maxInFlight int, wait time.Duration) *InvoiceLimiter {
+	return &InvoiceLimiter{
+		MaxInFlight: maxInFlight,
+		Wait:        wait,
+	}
+}
+
+// acquire takes a slot, to be given back by calling the returned func.
+func (limiter *InvoiceLimiter) acquire(ctx context.Context) (func(), error) {
+	if limiter.MaxInFlight <= 0 {
+		return func() {}, nil
+	}
+	limiter.once.Do(func() {
+		limiter.slots = make(chan struct{}, limiter.MaxInFlight)
+	})
+	release := func() { <-limiter.slots }
+	select {
+	case limiter.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if limiter.Wait <= 0 {
+		return nil, lsat.ErrInvoiceCapacity
+	}
+	timer := time.NewTimer(limiter.Wait)
+	defer timer.Stop()
+	select {
+	case limiter.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, lsat.ErrInvoiceCapacity
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %s", lsat.ErrInvoiceCapacity, ctx.Err().Error())
+	}
+}
+
+// ChallengeReuse hands a client that asks again for the same route the
+// challenge it was issued recently, as long as its invoice is unpaid,
+// rather than creating another invoice. Only challenges for new LSATs are
+// reused. A reused challenge keeps the valid_until caveats it was minted
+// with, so its LSAT may expire up to MaxAge earlier than a new one. The
+// zero value reuses nothing until MaxAge and KeyFunc are set.
+type ChallengeReuse struct {
+	// MaxAge is how long a challenge is reused, never past the expiry of
+	// its invoice
+	MaxAge time.Duration
+	// KeyFunc returns the client a challenge is reused for, "" for clients
+	// that always get a new one. Nothing is reused if nil. Clients with the
+	// same key are handed the same invoice and macaroon, so it must tell
+	// apart clients that shouldn't share one, e.g. by API key rather than
+	// by an IP address shared behind a NAT or proxy.
+	KeyFunc func(*http.Request) string
+
+	mu         sync.Mutex
+	challenges map[string]*reusedChallenge
+	keys       map[lntypes.Hash]string
+	expiries   reuseExpiries
+}
+
+type reusedChallenge struct {
+	challenge *Challenge
+	until     time.Time
+}
+
+type reuseExpiry struct {
+	key   string
+	until time.Time
+}
+
+// reuseExpiries is a min-heap of challenges by the end of their reuse
+type reuseExpiries []reuseExpiry
+
+func (expiries reuseExpiries) Len() int { return len(expiries) }
+func (expiries reuseExpiries) Less(i, j int) bool {
+	return expiries[i].until.Before(expiries[j].until)
+}
+func (expiries reuseExpiries) Swap(i, j int)       { expiries[i], expiries[j] = expiries[j], expiries[i] }
+func (expiries *reuseExpiries) Push(x interface{}) { *expiries = append(*expiries, x.(reuseExpiry)) }
+func (expiries *reuseExpiries) Pop() interface{} {
+	old := *expiries
+	last := old[len(old)-1]
+	*expiries = old[:len(old)-1]
+	return last
+}
+
+func NewChallengeReuse(maxAge time.Duration) *ChallengeReuse {
+	return &ChallengeReuse{
+		MaxAge:     maxAge,
+		challenges: make(map[string]*reusedChallenge),
+		keys:       make(map[lntypes.Hash]string),
+	}
+}
+
+// reuseKey identifies challenges for the same client, route, price and
+// caveats, "" if challenges for req aren't reused. valid_until caveats are
+// left out, as they usually count from now and would change the key every
+// second.
+func (reuse *ChallengeReuse) reuseKey(req *http.Request, amountMsat lnwire.MilliSatoshi, caveats []caveat.Caveat) string {
+	if reuse.KeyFunc == nil {
+		return ""
+	}
+	client := reuse.KeyFunc(req)
+	if client == "" {
+		return ""
+	}
+	hash := sha256.New()
+	for _, part := range []string{client, req.Method, req.Host, req.URL.Path, strconv.FormatInt(int64(amountMsat), 10)} {
+		hash.Write([]byte(strconv.Itoa(len(part)) + ":" + part))
+	}
+	for _, c := range caveats {
+		if c.Condition == caveat.VALID_UNTIL {
+			continue
+		}
+		encoded := caveat.EncodeCaveat(c)
+		hash.Write([]byte(strconv.Itoa(len(encoded)) + ":" + encoded))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (reuse *ChallengeReuse) get(key string) *Challenge {
+	reuse.mu.Lock()
+	defer reuse.mu.Unlock()
+	reused, ok := reuse.challenges[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(reused.until) {
+		reuse.remove(key)
+		return nil
+	}
+	return reused.challenge
+}
+
+func (reuse *ChallengeReuse) put(key string, challenge *Challenge) {
+	until := time.Now().Add(reuse.MaxAge)
+	if !challenge.ExpiresAt.IsZero() && challenge.ExpiresAt.Before(until) {
+		until = challenge.ExpiresAt
+	}
+	reuse.mu.Lock()
+	defer reuse.mu.Unlock()
+	if reuse.challenges == nil {
+		reuse.challenges = make(map[string]*reusedChallenge)
+		reuse.keys = make(map[lntypes.Hash]string)
+	}
+	reuse.evictExpired(time.Now())
+	reuse.remove(key)
+	reuse.challenges[key] = &reusedChallenge{challenge: challenge, until: until}
+	reuse.keys[challenge.PaymentHash] = key
+	heap.Push(&reuse.expiries, reuseExpiry{key: key, until: until})
+}
+
+// evictExpired drops the challenges no longer reused. Entries of the heap
+// outlive challenges replaced or forgotten since, those are skipped.
+func (reuse *ChallengeReuse) evictExpired(now time.Time) {
+	for reuse.expiries.Len() > 0 && now.After(reuse.expiries[0].until) {
+		expired := heap.Pop(&reuse.expiries).(reuseExpiry)
+		if reused, ok := reuse.challenges[expired.key]; ok && reused.until.Equal(expired.until) {
+			reuse.remove(expired.key)
+		}
+	}
+}
+
+// Forget stops reusing the challenge for paymentHash, e.g. once paid.
+func (reuse *ChallengeReuse) Forget(paymentHash lntypes.Hash) {
+	reuse.mu.Lock()
+	defer reuse.mu.Unlock()
+	if key, ok := reuse.keys[paymentHash]; ok {
+		reuse.remove(key)
+	}
+}
+
+func (reuse *ChallengeReuse) remove(key string) {
+	if reused, ok := reuse.challenges[key]; ok {
+		delete(reuse.keys, reused.challenge.PaymentHash)
+		delete(reuse.challenges, key)
+	}
+}
+
+// reusableChallenge returns the challenge recently issued for key if its
+// invoice is still pending. Without a way to look up invoices, challenges
+// are reused until an LSAT for them is verified.
+func (lsatMiddleware *LsatMiddleware) reusableChallenge(ctx context.Context, key string) *Challenge {
+	reuse := lsatMiddleware.ChallengeReuse
+	challenge := reuse.get(key)
+	if challenge == nil {
+		return nil
+	}
+	status, err := lsatMiddleware.GetInvoiceStatus(ctx, challenge.PaymentHash)
+	switch {
+	case errors.Is(err, ln.ErrInvoiceLookupUnsupported):
+		return challenge
+	case err != nil || status.Status != INVOICE_STATUS_PENDING:
+		reuse.Forget(challenge.PaymentHash)
+		return nil
+	}
+	return challenge
+}
@@ -0,0 +1,185 @@
+package middleware
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CONTENT_TYPE_JSON    = "application/json"
+	CONTENT_TYPE_PROBLEM = "application/problem+json"
+)
+
+// Response is what the middleware answers with when it doesn't pass a
+// request on: a 402 challenge, or an error such as a malformed LSAT.
+type Response struct {
+	Status    int
+	Message   string
+	Challenge *Challenge
+	Error     error
+}
+
+// ResponseRenderer writes the status and body of a Response. Headers such as
+// WWW-Authenticate are already set when it is called.
+type ResponseRenderer interface {
+	Render(w http.ResponseWriter, req *http.Request, response *Response) error
+}
+
+type ResponseRendererFunc func(w http.ResponseWriter, req *http.Request, response *Response) error
+
+func (f ResponseRendererFunc) Render(w http.ResponseWriter, req *http.Request, response *Response) error {
+	return f(w, req, response)
+}
+
+// JSONRenderer renders {"code": ..., "message": ...}, adding the invoice
+// details to 402 responses.
+type JSONRenderer struct{}
+
+func (renderer *JSONRenderer) Render(w http.ResponseWriter, req *http.Request, response *Response) error {
+	body := map[string]interface{}{
+		"code":    response.Status,
+		"message": response.Message,
+	}
+	addChallengeFields(body, response.Challenge)
+	return writeJSON(w, CONTENT_TYPE_JSON, response.Status, body)
+}
+
+// ProblemRenderer renders RFC 7807 problem details, with the invoice details
+// of 402 responses as extension members.
+type ProblemRenderer struct {
+	// Type is the problem type URI, "about:blank" when empty
+	Type string
+}
+
+func (renderer *ProblemRenderer) Render(w http.ResponseWriter, req *http.Request, response *Response) error {
+	problemType := renderer.Type
+	if problemType == "" {
+		problemType = "about:blank"
+	}
+	body := map[string]interface{}{
+		"type":   problemType,
+		"title":  http.StatusText(response.Status),
+		"status": response.Status,
+		"detail": response.Message,
+	}
+	addChallengeFields(body, response.Challenge)
+	return writeJSON(w, CONTENT_TYPE_PROBLEM, response.Status, body)
+}
+
+// NegotiatingRenderer picks a renderer by the media types in the request's
+// Accept header. Keys of Renderers are media types like "text/html", or
+// ranges like "text/*". Default is used when nothing matches.
+type NegotiatingRenderer struct {
+	Renderers map[string]ResponseRenderer
+	Default   ResponseRenderer
+}
+
+func (renderer *NegotiatingRenderer) Render(w http.ResponseWriter, req *http.Request, response *Response) error {
+	return renderer.Negotiate(req).Render(w, req, response)
+}
+
+func (renderer *NegotiatingRenderer) Negotiate(req *http.Request) ResponseRenderer {
+	for _, accepted := range parseAccept(req.Header.Get("Accept")) {
+		if r, ok := renderer.Renderers[accepted]; ok {
+			return r
+		}
+		if accepted == "*/*" {
+			break
+		}
+		// Match ranges on either side, e.g. "text/*" against "text/html"
+		for _, mediaType := range renderer.mediaTypes() {
+			if mediaRangeMatches(accepted, mediaType) || mediaRangeMatches(mediaType, accepted) {
+				return renderer.Renderers[mediaType]
+			}
+		}
+	}
+	if renderer.Default != nil {
+		return renderer.Default
+	}
+	return &JSONRenderer{}
+}
+
+func (renderer *NegotiatingRenderer) mediaTypes() []string {
+	mediaTypes := make([]string, 0, len(renderer.Renderers))
+	for mediaType := range renderer.Renderers {
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	sort.Strings(mediaTypes)
+	return mediaTypes
+}
+
+func mediaRangeMatches(mediaRange string, mediaType string) bool {
+	if !strings.HasSuffix(mediaRange, "/*") {
+		return false
+	}
+	return strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*"))
+}
+
+// parseAccept returns the media types of an Accept header ordered by
+// preference, leaving out those with q=0.
+func parseAccept(acceptField string) []string {
+	type acceptedType struct {
+		mediaType string
+		quality   float64
+	}
+	acceptedTypes := []acceptedType{}
+	for _, field := range strings.Split(acceptField, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(field))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+		acceptedTypes = append(acceptedTypes, acceptedType{mediaType: mediaType, quality: quality})
+	}
+	sort.SliceStable(acceptedTypes, func(i, j int) bool {
+		return acceptedTypes[i].quality > acceptedTypes[j].quality
+	})
+	mediaTypes := make([]string, 0, len(acceptedTypes))
+	for _, accepted := range acceptedTypes {
+		mediaTypes = append(mediaTypes, accepted.mediaType)
+	}
+	return mediaTypes
+}
+
+func addChallengeFields(body map[string]interface{}, challenge *Challenge) {
+	if challenge == nil {
+		return
+	}
+	body["macaroon"] = challenge.Macaroon
+	body["invoice"] = challenge.Invoice
+	body["payment_hash"] = challenge.PaymentHash.String()
+	body["amount"] = challenge.Amount
+	body["amount_msat"] = challenge.AmountMsat
+	if challenge.Upgrade {
+		body["upgrade"] = true
+	}
+	if challenge.TopUp {
+		body["top_up"] = true
+	}
+	if challenge.Renewal {
+		body["renewal"] = true
+	}
+	if !challenge.ExpiresAt.IsZero() {
+		body["expires_at"] = challenge.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, contentType string, status int, body interface{}) error {
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(body)
+}
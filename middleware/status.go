@@ -0,0 +1,266 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/ln"
+	macaroonutils "github.com/getAlby/lsat-middleware/macaroon"
+	"github.com/getAlby/lsat-middleware/utils"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+const (
+	INVOICE_STATUS_PENDING = "pending"
+	INVOICE_STATUS_SETTLED = "settled"
+	INVOICE_STATUS_EXPIRED = "expired"
+)
+
+const (
+	CONTENT_TYPE_EVENT_STREAM    = "text/event-stream"
+	DEFAULT_STATUS_POLL_INTERVAL = time.Second
+	MAX_STATUS_WAIT              = time.Minute
+	DEFAULT_MAX_STATUS_WAITERS   = 1000
+)
+
+var errTooManyStatusWaiters = errors.New("Too many status requests waiting")
+
+// InvoiceStatus is what the status endpoint reports. It never contains the
+// preimage, Ready only tells the client that the invoice has been paid.
+type InvoiceStatus struct {
+	PaymentHash string `json:"payment_hash"`
+	Status      string `json:"status"`
+	Ready       bool   `json:"ready"`
+}
+
+// GetInvoiceStatus reads the invoice from InvoiceStore, falling back to
+// looking it up with the active LN client. Only challenge invoices are
+// reported, other invoices of the node fail with ErrInvoiceNotFound like
+// unknown ones.
+func (lsatMiddleware *LsatMiddleware) GetInvoiceStatus(ctx context.Context, paymentHash lntypes.Hash) (*InvoiceStatus, error) {
+	invoiceState, err := lsatMiddleware.getInvoiceState(ctx, paymentHash)
+	if err != nil {
+		return nil, err
+	}
+	if invoiceState.Memo != INVOICE_MEMO {
+		return nil, ln.ErrInvoiceNotFound
+	}
+	return newInvoiceStatus(invoiceState), nil
+}
+
+func (lsatMiddleware *LsatMiddleware) getInvoiceState(ctx context.Context, paymentHash lntypes.Hash) (*ln.InvoiceState, error) {
+	if lsatMiddleware.InvoiceStore != nil {
+		invoiceState, err := lsatMiddleware.InvoiceStore.GetInvoice(ctx, paymentHash)
+		if err == nil {
+			return invoiceState, nil
+		}
+		if !errors.Is(err, ln.ErrInvoiceNotFound) {
+			return nil, err
+		}
+	}
+	lookupClient, ok := lsatMiddleware.LNClient.(ln.InvoiceLookupClient)
+	if !ok {
+		return nil, ln.ErrInvoiceLookupUnsupported
+	}
+	invoice, err := lookupClient.LookupInvoice(ctx, paymentHash)
+	if err != nil {
+		return nil, err
+	}
+	return ln.NewInvoiceState(invoice)
+}
+
+func newInvoiceStatus(invoiceState *ln.InvoiceState) *InvoiceStatus {
+	invoiceStatus := &InvoiceStatus{
+		PaymentHash: invoiceState.PaymentHash.String(),
+		Status:      INVOICE_STATUS_PENDING,
+	}
+	switch invoiceState.State {
+	case lnrpc.Invoice_SETTLED:
+		invoiceStatus.Status = INVOICE_STATUS_SETTLED
+		invoiceStatus.Ready = true
+	case lnrpc.Invoice_CANCELED:
+		invoiceStatus.Status = INVOICE_STATUS_EXPIRED
+	default:
+		if invoiceState.ExpiresAt.After(invoiceState.CreatedAt) && time.Now().After(invoiceState.ExpiresAt) {
+			invoiceStatus.Status = INVOICE_STATUS_EXPIRED
+		}
+	}
+	return invoiceStatus
+}
+
+// WaitForInvoiceStatus polls the invoice until it is no longer pending, ctx
+// is done or wait has passed, and returns the last status seen.
+func (lsatMiddleware *LsatMiddleware) WaitForInvoiceStatus(ctx context.Context, paymentHash lntypes.Hash, wait time.Duration) (*InvoiceStatus, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		invoiceStatus, err := lsatMiddleware.GetInvoiceStatus(ctx, paymentHash)
+		if err != nil {
+			return nil, err
+		}
+		if invoiceStatus.Status != INVOICE_STATUS_PENDING || !time.Now().Add(lsatMiddleware.statusPollInterval()).Before(deadline) {
+			return invoiceStatus, nil
+		}
+		select {
+		case <-ctx.Done():
+			return invoiceStatus, nil
+		case <-time.After(lsatMiddleware.statusPollInterval()):
+		}
+	}
+}
+
+// StatusHandler reports whether the invoice of a challenge has been paid.
+// The invoice is given by a payment_hash or macaroon query parameter. With
+// wait=<seconds> the request is held until the invoice is paid or expires,
+// and clients accepting text/event-stream get Server-Sent Events instead.
+// It never hands out the LSAT, only the payer holds the preimage and can
+// store it in the cookie with CookieHandler.
+func (lsatMiddleware *LsatMiddleware) StatusHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	paymentHash, err := lsatMiddleware.parseStatusQuery(query.Get("payment_hash"), query.Get("macaroon"))
+	if err != nil {
+		lsatMiddleware.renderStatusError(w, req, http.StatusBadRequest, err)
+		return
+	}
+	wait := time.Duration(0)
+	if waitField := query.Get("wait"); waitField != "" {
+		seconds, err := strconv.Atoi(waitField)
+		if err != nil || seconds < 0 {
+			lsatMiddleware.renderStatusError(w, req, http.StatusBadRequest, fmt.Errorf("Invalid wait: %s", waitField))
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait > MAX_STATUS_WAIT {
+		wait = MAX_STATUS_WAIT
+	}
+	stream := strings.Contains(req.Header.Get("Accept"), CONTENT_TYPE_EVENT_STREAM)
+	if (stream || wait > 0) && lsatMiddleware.StatusWaiters != nil {
+		release, err := lsatMiddleware.StatusWaiters.acquire(req.Context())
+		if err != nil {
+			lsatMiddleware.renderStatusError(w, req, http.StatusServiceUnavailable, errTooManyStatusWaiters)
+			return
+		}
+		defer release()
+	}
+	if stream {
+		if wait == 0 {
+			wait = MAX_STATUS_WAIT
+		}
+		lsatMiddleware.serveStatusEvents(w, req, paymentHash, wait)
+		return
+	}
+	invoiceStatus, err := lsatMiddleware.WaitForInvoiceStatus(req.Context(), paymentHash, wait)
+	if err != nil {
+		lsatMiddleware.renderLookupError(w, req, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, CONTENT_TYPE_JSON, http.StatusOK, invoiceStatus)
+}
+
+func (lsatMiddleware *LsatMiddleware) serveStatusEvents(w http.ResponseWriter, req *http.Request, paymentHash lntypes.Hash, wait time.Duration) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		lsatMiddleware.renderStatusError(w, req, http.StatusNotImplemented, errors.New("Streaming is not supported"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), wait)
+	defer cancel()
+
+	invoiceStatus, err := lsatMiddleware.GetInvoiceStatus(ctx, paymentHash)
+	if err != nil {
+		lsatMiddleware.renderLookupError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", CONTENT_TYPE_EVENT_STREAM)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	lastStatus := ""
+	for {
+		if invoiceStatus.Status != lastStatus {
+			data, err := json.Marshal(invoiceStatus)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+			flusher.Flush()
+			lastStatus = invoiceStatus.Status
+		}
+		if invoiceStatus.Status != INVOICE_STATUS_PENDING {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(lsatMiddleware.statusPollInterval()):
+		}
+		invoiceStatus, err = lsatMiddleware.GetInvoiceStatus(ctx, paymentHash)
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %q\n\n", err.Error())
+			flusher.Flush()
+			return
+		}
+	}
+}
+
+// parseStatusQuery takes the payment hash from the macaroon identifier
+// without checking the signature. The signature of challenges with
+// third-party caveats can't be checked before they are discharged, and the
+// macaroon doesn't reveal more than the payment_hash parameter.
+func (lsatMiddleware *LsatMiddleware) parseStatusQuery(paymentHashField string, macaroonField string) (lntypes.Hash, error) {
+	if macaroonField != "" {
+		// A "+" that wasn't URL encoded arrives as a space
+		mac, err := utils.GetMacaroonFromString(strings.ReplaceAll(macaroonField, " ", "+"))
+		if err != nil {
+			return lntypes.Hash{}, err
+		}
+		macaroonId, err := macaroonutils.GetMacIdFromMacaroon(mac)
+		if err != nil {
+			return lntypes.Hash{}, err
+		}
+		return macaroonId.PaymentHash, nil
+	}
+	if paymentHashField == "" {
+		return lntypes.Hash{}, errors.New("Either payment_hash or macaroon is required")
+	}
+	return lntypes.MakeHashFromStr(paymentHashField)
+}
+
+func (lsatMiddleware *LsatMiddleware) statusPollInterval() time.Duration {
+	if lsatMiddleware.StatusPollInterval == 0 {
+		return DEFAULT_STATUS_POLL_INTERVAL
+	}
+	return lsatMiddleware.StatusPollInterval
+}
+
+func (lsatMiddleware *LsatMiddleware) renderLookupError(w http.ResponseWriter, req *http.Request, err error) {
+	if errors.Is(err, ln.ErrInvoiceLookupUnsupported) {
+		lsatMiddleware.renderStatusError(w, req, http.StatusNotImplemented, err)
+		return
+	}
+	if errors.Is(err, ln.ErrInvoiceNotFound) {
+		// Without the details, which may differ between unknown invoices
+		// and invoices that aren't challenges
+		lsatMiddleware.renderStatusError(w, req, http.StatusNotFound, ln.ErrInvoiceNotFound)
+		return
+	}
+	lsatMiddleware.logger().ErrorContext(req.Context(), "Failed to look up invoice", slog.Any("error", err))
+	lsatMiddleware.renderStatusError(w, req, http.StatusBadGateway, err)
+}
+
+func (lsatMiddleware *LsatMiddleware) renderStatusError(w http.ResponseWriter, req *http.Request, status int, err error) {
+	lsatMiddleware.Render(w, req, &Response{
+		Status:  status,
+		Message: err.Error(),
+		Error:   err,
+	})
+}
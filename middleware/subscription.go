@@ -0,0 +1,276 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/ln"
+	"github.com/getAlby/lsat-middleware/lsat"
+	macaroonutils "github.com/getAlby/lsat-middleware/macaroon"
+	"github.com/getAlby/lsat-middleware/utils"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"gopkg.in/macaroon.v2"
+)
+
+type planFunc func(*http.Request) string
+
+// Plan is a subscription: LSATs sold for it are valid for Period and can be
+// renewed for another Period at RenewalHandler.
+type Plan struct {
+	Name   string
+	Period time.Duration
+	// Price in sats, if zero the request is priced by the AmountFunc of
+	// the middleware
+	Price int64
+}
+
+// SubscriptionStore records until when subscription LSATs were renewed, by
+// token ID. Implementations must be safe for concurrent use.
+type SubscriptionStore interface {
+	// PaidUntil returns the end of the renewed access of tokenId, the zero
+	// time if it was never renewed.
+	PaidUntil(ctx context.Context, tokenId [32]byte) (time.Time, error)
+	// Renew extends the access of tokenId by period, once per payment
+	// hash, from the later of from, its current end and now. It returns
+	// the new end.
+	Renew(ctx context.Context, tokenId [32]byte, paymentHash lntypes.Hash, from time.Time, period time.Duration) (time.Time, error)
+}
+
+// MemorySubscriptionStore keeps renewals in memory, they are lost on restart.
+type MemorySubscriptionStore struct {
+	mu        sync.Mutex
+	paidUntil map[[32]byte]time.Time
+	renewed   map[lntypes.Hash]bool
+}
+
+func NewMemorySubscriptionStore() *MemorySubscriptionStore {
+	return &MemorySubscriptionStore{
+		paidUntil: make(map[[32]byte]time.Time),
+		renewed:   make(map[lntypes.Hash]bool),
+	}
+}
+
+func (store *MemorySubscriptionStore) PaidUntil(ctx context.Context, tokenId [32]byte) (time.Time, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.paidUntil[tokenId], nil
+}
+
+func (store *MemorySubscriptionStore) Renew(ctx context.Context, tokenId [32]byte, paymentHash lntypes.Hash, from time.Time, period time.Duration) (time.Time, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.renewed[paymentHash] {
+		return store.paidUntil[tokenId], nil
+	}
+	start := time.Now()
+	for _, t := range []time.Time{from, store.paidUntil[tokenId]} {
+		if t.After(start) {
+			start = t
+		}
+	}
+	store.renewed[paymentHash] = true
+	store.paidUntil[tokenId] = start.Add(period)
+	return store.paidUntil[tokenId], nil
+}
+
+// plan returns the plan LSATs for req are sold for, nil if none.
+func (lsatMiddleware *LsatMiddleware) plan(req *http.Request) *Plan {
+	if lsatMiddleware.PlanFunc == nil {
+		return nil
+	}
+	return lsatMiddleware.findPlan(lsatMiddleware.PlanFunc(req))
+}
+
+func (lsatMiddleware *LsatMiddleware) findPlan(name string) *Plan {
+	for i := range lsatMiddleware.Plans {
+		if lsatMiddleware.Plans[i].Name == name {
+			return &lsatMiddleware.Plans[i]
+		}
+	}
+	return nil
+}
+
+// planCaveats returns the caveats of LSATs sold for plan, the subscription
+// expiry followed by the plan name.
+func planCaveats(plan *Plan) []caveat.Caveat {
+	return []caveat.Caveat{
+		caveat.ValidUntil(time.Now().Add(plan.Period)),
+		caveat.NewCaveat(caveat.PLAN, plan.Name),
+	}
+}
+
+func (lsatMiddleware *LsatMiddleware) planAmountMsat(req *http.Request, plan *Plan) (lnwire.MilliSatoshi, error) {
+	if plan.Price > 0 {
+		return lnwire.MilliSatoshi(plan.Price * ln.MSAT_PER_SAT), nil
+	}
+	return lsatMiddleware.amountMsat(req)
+}
+
+// verifySubscription verifies an LSAT that failed with ErrExpired against
+// the renewals of its subscription.
+func (lsatMiddleware *LsatMiddleware) verifySubscription(ctx context.Context, mac *macaroon.Macaroon, discharges []*macaroon.Macaroon, caveats []caveat.Caveat, preimage lntypes.Preimage) error {
+	paidUntil, err := lsatMiddleware.paidUntil(ctx, mac)
+	if err != nil {
+		return err
+	}
+	return lsat.VerifySubscription(ctx, mac, discharges, caveats, lsatMiddleware.RootKey, preimage, paidUntil)
+}
+
+func (lsatMiddleware *LsatMiddleware) paidUntil(ctx context.Context, mac *macaroon.Macaroon) (time.Time, error) {
+	macaroonId, err := macaroonutils.GetMacIdFromMacaroon(mac)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return lsatMiddleware.Subscriptions.PaidUntil(ctx, macaroonId.TokenId)
+}
+
+// checkNotRenewal rejects renewal LSATs, they only pay for renewals.
+func checkNotRenewal(caveats []caveat.Caveat) error {
+	for _, c := range caveats {
+		if c.Condition == caveat.RENEWS {
+			return fmt.Errorf("%w: %s", lsat.ErrCaveatMismatch, "Renewal LSATs are only accepted by the renewal endpoint")
+		}
+	}
+	return nil
+}
+
+// RenewalHandler renews subscription LSATs. Presented with a subscription
+// LSAT, expired or not, it answers with a challenge for the price of its
+// plan. Presented with the paid LSAT of that challenge, it extends the
+// subscription LSAT by the plan period and answers with its new expiry,
+// e.g. {"valid_until": "2024-02-01T00:00:00Z"}. Clients keep using their
+// subscription LSAT.
+func (lsatMiddleware *LsatMiddleware) RenewalHandler(w http.ResponseWriter, req *http.Request) {
+	if lsatMiddleware.Subscriptions == nil {
+		lsatMiddleware.renderStatusError(w, req, http.StatusNotImplemented, errors.New("Subscriptions are not supported"))
+		return
+	}
+	mac, discharges, preimage, err := utils.ParseLsatHeaderWithDischarges(lsatMiddleware.getAuthField(req))
+	if err != nil {
+		lsatMiddleware.renderStatusError(w, req, http.StatusUnauthorized, fmt.Errorf("%w: %s", lsat.ErrMalformedToken, err.Error()))
+		return
+	}
+	lsatInfo, err := lsat.GetPaidLsatInfo(mac, preimage)
+	if err != nil {
+		lsatMiddleware.renderStatusError(w, req, http.StatusUnauthorized, fmt.Errorf("%w: %s", lsat.ErrMalformedToken, err.Error()))
+		return
+	}
+	if isRenewal(mac) {
+		lsatMiddleware.renew(w, req, mac, discharges, lsatInfo)
+		return
+	}
+	lsatMiddleware.challengeRenewal(w, req, mac, discharges, lsatInfo)
+}
+
+// isRenewal reports whether mac was minted by challengeRenewal, which puts
+// the renews caveat first. Holders can only add caveats after those minted
+// with the macaroon, so they can't turn other LSATs into renewal LSATs.
+func isRenewal(mac *macaroon.Macaroon) bool {
+	caveats := mac.Caveats()
+	if len(caveats) == 0 || caveats[0].VerificationId != nil {
+		return false
+	}
+	first, err := caveat.DecodeCaveat(string(caveats[0].Id))
+	return err == nil && first.Condition == caveat.RENEWS
+}
+
+// renew extends the subscription of a paid renewal LSAT.
+func (lsatMiddleware *LsatMiddleware) renew(w http.ResponseWriter, req *http.Request, mac *macaroon.Macaroon, discharges []*macaroon.Macaroon, lsatInfo *lsat.LsatInfo) {
+	ctx := req.Context()
+	if err := lsat.VerifyLSATWithDischarges(ctx, mac, discharges, nil, lsatMiddleware.RootKey, lsatInfo.Preimage); err != nil {
+		lsatMiddleware.renderStatusError(w, req, http.StatusUnauthorized, err)
+		return
+	}
+	var plan *Plan
+	var from *time.Time
+	for _, c := range lsatInfo.Caveats {
+		switch c.Condition {
+		case caveat.RENEWS:
+			if plan == nil {
+				plan = lsatMiddleware.findPlan(c.Value)
+			}
+		case caveat.RENEWS_FROM:
+			// Repeated caveats can only bring the start forward
+			unix, err := strconv.ParseInt(c.Value, 10, 64)
+			if err != nil {
+				lsatMiddleware.renderStatusError(w, req, http.StatusUnauthorized, lsat.ErrCaveatMismatch)
+				return
+			}
+			if t := time.Unix(unix, 0); from == nil || t.Before(*from) {
+				from = &t
+			}
+		}
+	}
+	if plan == nil || from == nil {
+		lsatMiddleware.renderStatusError(w, req, http.StatusBadRequest, errors.New("Unknown plan"))
+		return
+	}
+	paidUntil, err := lsatMiddleware.Subscriptions.Renew(ctx, lsatInfo.TokenId, lsatInfo.PaymentHash, *from, plan.Period)
+	if err != nil {
+		lsatMiddleware.renderStatusError(w, req, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, CONTENT_TYPE_JSON, http.StatusOK, map[string]interface{}{
+		"plan":        plan.Name,
+		"valid_until": paidUntil.UTC().Format(time.RFC3339),
+	})
+}
+
+// challengeRenewal answers a subscription LSAT with a challenge for a
+// renewal LSAT with the same token ID.
+func (lsatMiddleware *LsatMiddleware) challengeRenewal(w http.ResponseWriter, req *http.Request, mac *macaroon.Macaroon, discharges []*macaroon.Macaroon, lsatInfo *lsat.LsatInfo) {
+	ctx := req.Context()
+	paidUntil, err := lsatMiddleware.paidUntil(ctx, mac)
+	if err != nil {
+		lsatMiddleware.renderStatusError(w, req, http.StatusInternalServerError, err)
+		return
+	}
+	// Expired subscriptions are renewed as well
+	err = lsat.VerifySubscription(ctx, mac, discharges, nil, lsatMiddleware.RootKey, lsatInfo.Preimage, paidUntil)
+	if err != nil && !errors.Is(err, lsat.ErrExpired) {
+		lsatMiddleware.renderStatusError(w, req, http.StatusUnauthorized, err)
+		return
+	}
+	_, expiry, ok := lsat.SubscriptionExpiry(mac)
+	var plan *Plan
+	for _, c := range lsatInfo.Caveats {
+		if c.Condition == caveat.PLAN {
+			plan = lsatMiddleware.findPlan(c.Value)
+			break
+		}
+	}
+	if !ok || plan == nil {
+		lsatMiddleware.renderStatusError(w, req, http.StatusBadRequest, errors.New("LSAT is not a subscription"))
+		return
+	}
+	if paidUntil.After(expiry) {
+		expiry = paidUntil
+	}
+	amountMsat, err := lsatMiddleware.planAmountMsat(req, plan)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", lsat.ErrPricing, err.Error())
+		lsatMiddleware.renderStatusError(w, req, ChallengeErrorStatus(err), err)
+		return
+	}
+	challenge, err := lsatMiddleware.issueChallenge(ctx, req, lsatInfo, &lsatInfo.TokenId, &Challenge{
+		AmountMsat: amountMsat,
+		Caveats: []caveat.Caveat{
+			caveat.NewCaveat(caveat.RENEWS, plan.Name),
+			caveat.NewCaveat(caveat.RENEWS_FROM, strconv.FormatInt(expiry.Unix(), 10)),
+		},
+		Renewal: true,
+	})
+	if err != nil {
+		lsatMiddleware.renderStatusError(w, req, ChallengeErrorStatus(err), err)
+		return
+	}
+	lsatMiddleware.WriteChallenge(w, req, lsatInfo, challenge)
+}
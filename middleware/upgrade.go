@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/lsat"
+	"github.com/getAlby/lsat-middleware/tier"
+)
+
+// Upgradable reports whether the LSAT of lsatInfo was rejected only for its
+// tier or balance. CreateChallenge then offers an upgrade or top-up, or a
+// new LSAT if the old one can't be kept.
+func Upgradable(lsatInfo *lsat.LsatInfo) bool {
+	return lsatInfo != nil && (errors.Is(lsatInfo.Error, lsat.ErrInsufficientTier) || errors.Is(lsatInfo.Error, lsat.ErrInsufficientBalance))
+}
+
+// upgradableFrom returns the tier the LSAT described by lsatInfo was bought
+// for, if it was rejected for its tier only and can be upgraded to
+// selected by paying the price difference. LSATs with max_uses caveats or
+// narrowed capabilities aren't upgraded, as the upgrade would drop those
+// restrictions.
+func (lsatMiddleware *LsatMiddleware) upgradableFrom(lsatInfo *lsat.LsatInfo, selected *tier.Tier) (*tier.Tier, bool) {
+	if lsatInfo == nil || !errors.Is(lsatInfo.Error, lsat.ErrInsufficientTier) {
+		return nil, false
+	}
+	held, ok := tier.Held(lsatMiddleware.Tiers, lsatInfo.Caveats, selected.Service)
+	if !ok || held.Level >= selected.Level || held.Price <= 0 || selected.Price <= held.Price {
+		return nil, false
+	}
+	for _, c := range lsatInfo.Caveats {
+		switch c.Condition {
+		case caveat.MAX_USES:
+			return nil, false
+		case held.Service + tier.CAPABILITIES_SUFFIX:
+			if c.Value != strings.Join(held.Capabilities, ",") {
+				return nil, false
+			}
+		}
+	}
+	return held, true
+}
+
+// upgradeCaveats returns the caveats of lsatInfo the upgraded LSAT keeps,
+// all but those of its tier and the route conditions in caveats.
+func upgradeCaveats(lsatInfo *lsat.LsatInfo, service string, caveats []caveat.Caveat) []caveat.Caveat {
+	return carryCaveats(lsatInfo, caveats, tier.SERVICES, service+tier.CAPABILITIES_SUFFIX)
+}
+
+// carryCaveats returns the caveats of lsatInfo a replacing LSAT with the
+// route conditions in caveats keeps, all but those conditions and
+// dropped. Expiry is always kept, replacing an LSAT doesn't extend its
+// lifetime.
+func carryCaveats(lsatInfo *lsat.LsatInfo, caveats []caveat.Caveat, dropped ...string) []caveat.Caveat {
+	replaced := map[string]bool{}
+	for _, condition := range dropped {
+		replaced[condition] = true
+	}
+	for _, c := range caveats {
+		if c.Condition != caveat.VALID_UNTIL {
+			replaced[c.Condition] = true
+		}
+	}
+	kept := []caveat.Caveat{}
+	for _, c := range lsatInfo.Caveats {
+		if !replaced[c.Condition] {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
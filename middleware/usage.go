@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/getAlby/lsat-middleware/lsat"
+
+	"gopkg.in/macaroon.v2"
+)
+
+// UsageStore counts the uses of LSATs carrying max_uses caveats.
+// Implementations must be safe for concurrent use.
+type UsageStore interface {
+	// Increment adds one use to key and returns the number of uses
+	// including this one.
+	Increment(ctx context.Context, key string) (int64, error)
+	// Decrement takes back a use of key counted by Increment, for requests
+	// rejected after their uses were counted.
+	Decrement(ctx context.Context, key string) error
+}
+
+// MemoryUsageStore counts uses in memory. Counts are lost on restart and
+// never dropped, use a persistent store for long running processes.
+type MemoryUsageStore struct {
+	mu   sync.Mutex
+	uses map[string]int64
+}
+
+func NewMemoryUsageStore() *MemoryUsageStore {
+	return &MemoryUsageStore{
+		uses: make(map[string]int64),
+	}
+}
+
+func (store *MemoryUsageStore) Increment(ctx context.Context, key string) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.uses[key]++
+	return store.uses[key], nil
+}
+
+func (store *MemoryUsageStore) Decrement(ctx context.Context, key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.uses[key] > 0 {
+		store.uses[key]--
+	}
+	return nil
+}
+
+// checkUses counts a use of every max_uses caveat of mac. LSATs with
+// max_uses caveats are rejected if there is no UsageStore to count them.
+// The uses are taken back if the request is rejected, by checkUses itself
+// or by calling the returned func.
+func (lsatMiddleware *LsatMiddleware) checkUses(ctx context.Context, mac *macaroon.Macaroon) (func(), error) {
+	useLimits, err := lsat.UseLimits(mac)
+	if err != nil {
+		return nil, err
+	}
+	if len(useLimits) == 0 {
+		return func() {}, nil
+	}
+	if lsatMiddleware.UsageStore == nil {
+		return nil, fmt.Errorf("%w: %s", lsat.ErrCaveatMismatch, "max_uses caveats need a UsageStore")
+	}
+	counted := []string{}
+	undo := func() {
+		for _, key := range counted {
+			if err := lsatMiddleware.UsageStore.Decrement(ctx, key); err != nil {
+				lsatMiddleware.logger().ErrorContext(ctx, "Failed to take back LSAT use", slog.Any("error", err))
+			}
+		}
+	}
+	for _, useLimit := range useLimits {
+		uses, err := lsatMiddleware.UsageStore.Increment(ctx, useLimit.Key)
+		if err != nil {
+			undo()
+			return nil, err
+		}
+		counted = append(counted, useLimit.Key)
+		if uses > useLimit.MaxUses {
+			undo()
+			return nil, fmt.Errorf("%w: used more than %d times", lsat.ErrCaveatMismatch, useLimit.MaxUses)
+		}
+	}
+	return undo, nil
+}
@@ -0,0 +1,110 @@
+package paywall
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/lsat"
+	"github.com/getAlby/lsat-middleware/middleware"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	CONTENT_TYPE_HTML     = "text/html"
+	DEFAULT_POLL_INTERVAL = 2 * time.Second
+	QR_CODE_SIZE          = 280
+)
+
+//go:embed paywall.html
+var paywallHTML string
+
+var paywallTemplate = template.Must(template.New("paywall").Parse(paywallHTML))
+
+// Renderer renders challenges as an HTML page showing the invoice as a QR
+// code, with a WebLN button for browsers that have a wallet extension.
+// Once paid through WebLN the page either posts the LSAT to the cookie
+// endpoint and reloads, or reloads the content with the LSAT in the
+// Authorization header.
+type Renderer struct {
+	// Title of the page, lsat.PAYMENT_REQUIRED_MESSAGE if empty
+	Title string
+	// CookieURL is where LsatMiddleware.CookieHandler is mounted. If empty
+	// the page fetches the content with an Authorization header instead.
+	CookieURL string
+	// StatusURL is where LsatMiddleware.StatusHandler is mounted. If set, the
+	// page long-polls it until the invoice is paid, e.g. by scanning the QR
+	// code, and then asks for the preimage shown by the paying wallet.
+	StatusURL string
+	// PollInterval is how long to wait before retrying a failed poll
+	PollInterval time.Duration
+}
+
+type paywallPage struct {
+	Title          string
+	Message        string
+	Challenge      *middleware.Challenge
+	Amount         string
+	PaymentURI     template.URL
+	QRCode         template.URL
+	CookieURL      string
+	StatusURL      string
+	PollIntervalMs int64
+}
+
+func (renderer *Renderer) Render(w http.ResponseWriter, req *http.Request, response *middleware.Response) error {
+	page := &paywallPage{
+		Title:     renderer.Title,
+		Message:   response.Message,
+		Challenge: response.Challenge,
+		CookieURL: renderer.CookieURL,
+		StatusURL: renderer.StatusURL,
+	}
+	if page.Title == "" {
+		page.Title = lsat.PAYMENT_REQUIRED_MESSAGE
+	}
+	pollInterval := renderer.PollInterval
+	if pollInterval == 0 {
+		pollInterval = DEFAULT_POLL_INTERVAL
+	}
+	page.PollIntervalMs = pollInterval.Milliseconds()
+	if response.Challenge != nil {
+		paymentURI := "lightning:" + response.Challenge.Invoice
+		qrCode, err := GetQRCodeDataURI(strings.ToUpper(paymentURI))
+		if err != nil {
+			return err
+		}
+		page.PaymentURI = template.URL(paymentURI)
+		page.QRCode = template.URL(qrCode)
+		page.Amount = formatSats(response.Challenge.AmountMsat)
+	} else {
+		page.Title = http.StatusText(response.Status)
+	}
+	w.Header().Set("Content-Type", CONTENT_TYPE_HTML+"; charset=utf-8")
+	w.WriteHeader(response.Status)
+	return paywallTemplate.Execute(w, page)
+}
+
+// formatSats shows fractions of sats only for sub-sat prices, e.g. 1.5
+func formatSats(amountMsat lnwire.MilliSatoshi) string {
+	if amountMsat%1000 == 0 {
+		return strconv.FormatUint(uint64(amountMsat/1000), 10)
+	}
+	return strings.TrimRight(fmt.Sprintf("%d.%03d", uint64(amountMsat/1000), uint64(amountMsat%1000)), "0")
+}
+
+// GetQRCodeDataURI encodes content as a PNG QR code in a data URI
+func GetQRCodeDataURI(content string) (string, error) {
+	png, err := qrcode.Encode(content, qrcode.Medium, QR_CODE_SIZE)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("data:image/png;base64,%s", base64.StdEncoding.EncodeToString(png)), nil
+}
@@ -0,0 +1,57 @@
+package test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/middleware"
+	"github.com/getAlby/lsat-middleware/paywall"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaywallRenderer(t *testing.T) {
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{})
+	lsatmiddleware.ResponseRenderer = &middleware.NegotiatingRenderer{
+		Renderers: map[string]middleware.ResponseRenderer{
+			paywall.CONTENT_TYPE_HTML: &paywall.Renderer{
+				CookieURL: "/lsat/cookie",
+				StatusURL: "/lsat/status",
+			},
+		},
+	}
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	router := gofight.New()
+
+	router.GET("/protected").
+		SetHeader(gofight.H{
+			"Accept": "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			body := res.Body.String()
+			invoice := strings.Split(res.HeaderMap.Get("Www-Authenticate"), "invoice=")[1]
+
+			assert.Equal(t, http.StatusPaymentRequired, res.Code)
+			assert.Equal(t, "text/html; charset=utf-8", res.HeaderMap.Get("Content-Type"))
+			assert.Contains(t, body, `src="data:image/png;base64,`)
+			assert.Contains(t, body, `href="lightning:`+invoice+`"`)
+			assert.Contains(t, body, "window.webln.sendPayment")
+			assert.Contains(t, body, "<strong>10 sats</strong>")
+			assert.Contains(t, body, `var cookieURL = "/lsat/cookie";`)
+		})
+
+	router.GET("/protected").
+		SetHeader(gofight.H{
+			"Accept":        "text/html",
+			"Authorization": "LSAT not-a-token",
+		}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, res.Code)
+			assert.Contains(t, res.Body.String(), "<title>Unauthorized</title>")
+			assert.NotContains(t, res.Body.String(), "<script>")
+		})
+}
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/lsat"
+	macaroonutils "github.com/getAlby/lsat-middleware/macaroon"
+	"github.com/getAlby/lsat-middleware/utils"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+// expiredSubscriptionLsat mints a monthly subscription LSAT whose period
+// ended a minute ago
+func expiredSubscriptionLsat(t *testing.T) string {
+	preimage, err := utils.GetPreimageFromString(TEST_PREIMAGE_VALID)
+	assert.NoError(t, err)
+	caveats := append(PathCaveat(httptest.NewRequest(http.MethodGet, "/protected", nil)),
+		caveat.ValidUntil(time.Now().Add(-time.Minute)),
+		caveat.NewCaveat(caveat.PLAN, "monthly"),
+	)
+	macaroonString, err := macaroonutils.GetMacaroonAsString(preimage.Hash(), 100000, caveats, []byte(ROOT_KEY))
+	assert.NoError(t, err)
+	return fmt.Sprintf("LSAT %s:%s", macaroonString, TEST_PREIMAGE_VALID)
+}
+
+func TestSubscriptionRenewal(t *testing.T) {
+	lnClient := &MockLNClient{}
+	handler := strictLsatHandler(lnClient, withPlan(time.Hour))
+	subscription, challenge := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	assert.Equal(t, int64(100), challenge.Get("amount").Int())
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", subscription))
+
+	expired := expiredSubscriptionLsat(t)
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/protected", expired))
+
+	renewal, challenge := buyTestLsat(t, lnClient, handler, gofight.New().POST("/lsat/renew").
+		SetHeader(gofight.H{"Authorization": expired}))
+	assert.True(t, challenge.Get("renewal").Bool())
+	assert.Equal(t, int64(100), challenge.Get("amount").Int())
+	assert.Equal(t, tokenId(t, expired), tokenId(t, renewal))
+	// Renewal LSATs don't grant access themselves
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/protected", renewal))
+
+	gofight.New().POST("/lsat/renew").
+		SetHeader(gofight.H{"Authorization": renewal}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, res.Code)
+			validUntil, err := time.Parse(time.RFC3339, gjson.Get(res.Body.String(), "valid_until").String())
+			assert.NoError(t, err)
+			assert.True(t, validUntil.After(time.Now()))
+		})
+	// The expired subscription LSAT is valid again
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", expired))
+}
+
+func TestSubscriptionRenewalForged(t *testing.T) {
+	lnClient := &MockLNClient{}
+	handler := strictLsatHandler(lnClient, withPlan(-time.Hour))
+	subscription, _ := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	forged, err := lsat.Attenuate(subscription, []caveat.Caveat{
+		caveat.NewCaveat(caveat.RENEWS, "monthly"),
+		caveat.NewCaveat(caveat.RENEWS_FROM, fmt.Sprint(time.Now().Add(time.Hour).Unix())),
+	})
+	assert.NoError(t, err)
+
+	// Renews caveats added by the holder don't make a renewal LSAT
+	_, challenge := buyTestLsat(t, lnClient, handler, gofight.New().POST("/lsat/renew").
+		SetHeader(gofight.H{"Authorization": forged}))
+	assert.True(t, challenge.Get("renewal").Bool())
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/protected", subscription))
+}
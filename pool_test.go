@@ -0,0 +1,100 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/lsat"
+	"github.com/getAlby/lsat-middleware/middleware"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// poolingLNClient checks that pooled invoices are created with a request
+type poolingLNClient struct {
+	*MockLNClient
+	t *testing.T
+}
+
+func (client *poolingLNClient) AddInvoice(ctx context.Context, lnInvoice *lnrpc.Invoice, httpReq *http.Request, options ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error) {
+	if assert.NotNil(client.t, httpReq) {
+		assert.Equal(client.t, "1", httpReq.Header.Get(middleware.INVOICE_POOL_HEADER))
+	}
+	return client.MockLNClient.AddInvoice(ctx, lnInvoice, httpReq, options...)
+}
+
+func TestInvoicePool(t *testing.T) {
+	lnClient := &MockLNClient{}
+	lsatmiddleware := mockLsatMiddleware(lnClient)
+	lsatmiddleware.LNClient = &poolingLNClient{MockLNClient: lnClient, t: t}
+	lsatmiddleware.InvoicePool = middleware.NewInvoicePool(2, 10000)
+	pooled := 0
+	lsatmiddleware.OnInvoiceCreated = func(req *http.Request, lsatInfo *lsat.LsatInfo, metadata *middleware.HookMetadata) {
+		// Hooks run for the request taking the pooled invoice
+		assert.Equal(t, "/protected", req.URL.Path)
+		if metadata.Pooled {
+			pooled++
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lsatmiddleware.RunInvoicePool(ctx)
+	assert.Eventually(t, func() bool {
+		return lsatmiddleware.InvoicePool.Len(10000) == 2
+	}, time.Second, 10*time.Millisecond)
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	authorization, challenge := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	assert.NotEmpty(t, challenge.Get("invoice").String())
+	assert.Equal(t, 1, pooled)
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", authorization))
+
+	// The taken invoice is replaced
+	assert.Eventually(t, func() bool {
+		return lsatmiddleware.InvoicePool.Len(10000) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 3, lnClient.Invoices())
+}
+
+func TestInvoicePoolDiscardsExpiring(t *testing.T) {
+	lnClient := &MockLNClient{}
+	lsatmiddleware := mockLsatMiddleware(lnClient)
+	lsatmiddleware.InvoicePool = middleware.NewInvoicePool(1, 10000)
+	// The test invoices expire after an hour
+	lsatmiddleware.InvoicePool.MinLifetime = 2 * time.Hour
+	lsatmiddleware.InvoicePool.RefillInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lsatmiddleware.RunInvoicePool(ctx)
+
+	assert.Eventually(t, func() bool {
+		return lnClient.Invoices() >= 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, lsatmiddleware.InvoicePool.Len(10000))
+}
+
+func TestInvoicePoolZeroValue(t *testing.T) {
+	lnClient := &MockLNClient{}
+	lsatmiddleware := mockLsatMiddleware(lnClient)
+	lsatmiddleware.InvoicePool = &middleware.InvoicePool{AmountsMsat: []lnwire.MilliSatoshi{10000}, Size: 1}
+	assert.Equal(t, 0, lsatmiddleware.InvoicePool.Len(10000))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lsatmiddleware.RunInvoicePool(ctx)
+	assert.Eventually(t, func() bool {
+		return lsatmiddleware.InvoicePool.Len(10000) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+	buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	assert.Eventually(t, func() bool {
+		return lnClient.Invoices() == 2
+	}, time.Second, 10*time.Millisecond)
+}
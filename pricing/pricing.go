@@ -0,0 +1,279 @@
+package pricing
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/tier"
+
+	"gopkg.in/yaml.v3"
+)
+
+const DEFAULT_WATCH_INTERVAL = 5 * time.Second
+
+// Rule prices the requests matching Method and Path.
+//
+// Path segments starting with ':' match any single segment and one
+// starting with '*' matches the rest of the path, as in gin and echo.
+// Caveat values may refer to matched segments as {name}.
+type Rule struct {
+	// Method is matched case-insensitively, empty or "*" match any method
+	Method  string            `yaml:"method"`
+	Path    string            `yaml:"path"`
+	Price   int64             `yaml:"price"`
+	Caveats map[string]string `yaml:"caveats"`
+	// Service, Tier and Capabilities declare the tier.Requirement of the
+	// route, if Service is set
+	Service      string   `yaml:"service"`
+	Tier         uint8    `yaml:"tier"`
+	Capabilities []string `yaml:"capabilities"`
+}
+
+// Config is the content of a pricing file. Rules are tried in order and the
+// first match wins, requests matching no rule cost DefaultPrice, which must be
+// positive like the prices of rules.
+type Config struct {
+	DefaultPrice int64  `yaml:"default_price"`
+	Rules        []Rule `yaml:"rules"`
+}
+
+// ParseConfig reads a Config from YAML or JSON.
+func ParseConfig(data []byte) (Config, error) {
+	config := Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return Config{}, fmt.Errorf("Invalid pricing config: %s", err.Error())
+	}
+	return config, nil
+}
+
+type compiledRule struct {
+	rule     Rule
+	method   string
+	segments []string
+}
+
+// Table prices requests by the rules of a Config. AmountFunc, CaveatFunc and
+// RequirementFunc each match the request on their own, so a challenge minted
+// while the table is updated may combine the price of the old rules with the
+// caveats of the new ones. Challenges are only ever minted from rules the
+// table has held, but update it with care if prices and caveats must change
+// together.
+type Table struct {
+	mu           sync.RWMutex
+	rules        []compiledRule
+	defaultPrice int64
+}
+
+func NewTable(config Config) (*Table, error) {
+	table := &Table{}
+	if err := table.Update(config); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// LoadFile creates a Table from a YAML or JSON file.
+func LoadFile(path string) (*Table, error) {
+	table := &Table{}
+	if err := table.Reload(path); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// Update replaces the rules of table. An invalid config leaves them as they were.
+func (table *Table) Update(config Config) error {
+	if config.DefaultPrice <= 0 {
+		return fmt.Errorf("Invalid default price: %d", config.DefaultPrice)
+	}
+	rules := make([]compiledRule, 0, len(config.Rules))
+	for _, rule := range config.Rules {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, compiled)
+	}
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	table.rules = rules
+	table.defaultPrice = config.DefaultPrice
+	return nil
+}
+
+// Reload replaces the rules of table with those in the file at path.
+func (table *Table) Reload(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	config, err := ParseConfig(data)
+	if err != nil {
+		return err
+	}
+	return table.Update(config)
+}
+
+// Watch reloads the file at path whenever its modification time or size
+// changes, checking every interval until ctx is done. The first check always
+// reloads, so that changes made since the table was loaded aren't missed.
+// Failed reloads are passed to onError and keep the previous rules.
+func (table *Table) Watch(ctx context.Context, path string, interval time.Duration, onError func(error)) {
+	if interval <= 0 {
+		interval = DEFAULT_WATCH_INTERVAL
+	}
+	var modTime time.Time
+	var size int64
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			if onError != nil {
+				onError(err)
+			}
+			continue
+		}
+		if info.ModTime().Equal(modTime) && info.Size() == size {
+			continue
+		}
+		modTime, size = info.ModTime(), info.Size()
+		if err := table.Reload(path); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+// Match returns the first rule matching req and the path segments matched
+// by its parameters.
+func (table *Table) Match(req *http.Request) (*Rule, map[string]string, bool) {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	segments := splitPath(req.URL.Path)
+	for i := range table.rules {
+		compiled := &table.rules[i]
+		if compiled.method != "" && compiled.method != req.Method {
+			continue
+		}
+		if params, ok := matchSegments(compiled.segments, segments); ok {
+			rule := compiled.rule
+			return &rule, params, true
+		}
+	}
+	return nil, nil, false
+}
+
+// AmountFunc can be set as LsatMiddleware.AmountFunc.
+func (table *Table) AmountFunc(req *http.Request) int64 {
+	rule, _, ok := table.Match(req)
+	if !ok {
+		table.mu.RLock()
+		defer table.mu.RUnlock()
+		return table.defaultPrice
+	}
+	return rule.Price
+}
+
+// CaveatFunc can be set as LsatMiddleware.CaveatFunc. Caveats are sorted by
+// condition, so that the same request always yields the same caveats.
+func (table *Table) CaveatFunc(req *http.Request) []caveat.Caveat {
+	rule, params, ok := table.Match(req)
+	if !ok {
+		return []caveat.Caveat{}
+	}
+	caveats := make([]caveat.Caveat, 0, len(rule.Caveats))
+	for condition, value := range rule.Caveats {
+		for name, param := range params {
+			value = strings.ReplaceAll(value, "{"+name+"}", param)
+		}
+		caveats = append(caveats, caveat.NewCaveat(condition, value))
+	}
+	sort.Slice(caveats, func(i, j int) bool {
+		return caveats[i].Condition < caveats[j].Condition
+	})
+	return caveats
+}
+
+// RequirementFunc can be set as LsatMiddleware.RequirementFunc.
+func (table *Table) RequirementFunc(req *http.Request) *tier.Requirement {
+	rule, _, ok := table.Match(req)
+	if !ok || rule.Service == "" {
+		return nil
+	}
+	return &tier.Requirement{
+		Service:      rule.Service,
+		Tier:         rule.Tier,
+		Capabilities: rule.Capabilities,
+	}
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	if !strings.HasPrefix(rule.Path, "/") {
+		return compiledRule{}, fmt.Errorf("Invalid path pattern: %q", rule.Path)
+	}
+	if rule.Price <= 0 {
+		return compiledRule{}, fmt.Errorf("Invalid price for %s: %d", rule.Path, rule.Price)
+	}
+	segments := splitPath(rule.Path)
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "*") && i != len(segments)-1 {
+			return compiledRule{}, fmt.Errorf("Wildcard must be the last segment: %q", rule.Path)
+		}
+	}
+	for condition := range rule.Caveats {
+		if strings.Contains(condition, "=") {
+			return compiledRule{}, fmt.Errorf("Caveat conditions of %s can't contain '='", rule.Path)
+		}
+	}
+	method := strings.ToUpper(rule.Method)
+	if method == "*" {
+		method = ""
+	}
+	return compiledRule{rule: rule, method: method, segments: segments}, nil
+}
+
+func matchSegments(pattern, segments []string) (map[string]string, bool) {
+	params := map[string]string{}
+	for i, segment := range pattern {
+		if strings.HasPrefix(segment, "*") {
+			if name := segment[1:]; name != "" {
+				params[name] = strings.Join(segments[i:], "/")
+			}
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		if strings.HasPrefix(segment, ":") {
+			params[segment[1:]] = segments[i]
+			continue
+		}
+		if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, len(pattern) == len(segments)
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
@@ -0,0 +1,119 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/pricing"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+const TEST_PRICING_YAML = `
+default_price: 5
+rules:
+  - method: GET
+    path: /protected
+    price: 20
+  - path: /articles/:id
+    price: 50
+    caveats:
+      article: "{id}"
+  - method: post
+    path: /files/*path
+    price: 100
+    caveats:
+      file: "{path}"
+`
+
+func TestPricingTable(t *testing.T) {
+	config, err := pricing.ParseConfig([]byte(TEST_PRICING_YAML))
+	assert.NoError(t, err)
+	table, err := pricing.NewTable(config)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		method  string
+		path    string
+		price   int64
+		caveats []caveat.Caveat
+	}{
+		{http.MethodGet, "/protected", 20, []caveat.Caveat{}},
+		{http.MethodPost, "/protected", 5, []caveat.Caveat{}},
+		{http.MethodDelete, "/articles/42", 50, []caveat.Caveat{caveat.NewCaveat("article", "42")}},
+		{http.MethodGet, "/articles/42/comments", 5, []caveat.Caveat{}},
+		{http.MethodPost, "/files/a/b.txt", 100, []caveat.Caveat{caveat.NewCaveat("file", "a/b.txt")}},
+		{http.MethodPost, "/files", 100, []caveat.Caveat{caveat.NewCaveat("file", "")}},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest(testCase.method, testCase.path, nil)
+		assert.Equal(t, testCase.price, table.AmountFunc(req), testCase.path)
+		assert.Equal(t, testCase.caveats, table.CaveatFunc(req), testCase.path)
+	}
+
+	_, err = pricing.ParseConfig([]byte(`{"default_price": 1, "rules": [{"path": "/json", "price": 2}]}`))
+	assert.NoError(t, err)
+	_, err = pricing.ParseConfig([]byte(`rules: [{path: /a, cost: 2}]`))
+	assert.Error(t, err)
+	_, err = pricing.NewTable(pricing.Config{DefaultPrice: 5, Rules: []pricing.Rule{{Path: "/*rest/more", Price: 1}}})
+	assert.Error(t, err)
+	assert.Error(t, table.Update(pricing.Config{DefaultPrice: 5, Rules: []pricing.Rule{{Path: "/free", Price: 0}}}))
+	assert.Error(t, table.Update(pricing.Config{Rules: []pricing.Rule{{Path: "/protected", Price: 30}}}))
+	assert.Equal(t, int64(20), table.AmountFunc(httptest.NewRequest(http.MethodGet, "/protected", nil)))
+}
+
+func TestPricingTableMiddleware(t *testing.T) {
+	config, err := pricing.ParseConfig([]byte(TEST_PRICING_YAML))
+	assert.NoError(t, err)
+	table, err := pricing.NewTable(config)
+	assert.NoError(t, err)
+
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{})
+	lsatmiddleware.AmountFunc = table.AmountFunc
+	lsatmiddleware.CaveatFunc = table.CaveatFunc
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	gofight.New().GET("/protected").
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPaymentRequired, res.Code)
+			assert.Equal(t, int64(20), gjson.Get(res.Body.String(), "amount").Int())
+		})
+}
+
+func TestPricingTableWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pricing.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(TEST_PRICING_YAML), 0644))
+	table, err := pricing.LoadFile(path)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 10)
+	go table.Watch(ctx, path, 10*time.Millisecond, func(err error) {
+		errs <- err
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	assert.NoError(t, os.WriteFile(path, []byte("{default_price: 5, rules: [{path: /protected, price: 30}]}"), 0644))
+	assert.Eventually(t, func() bool {
+		return table.AmountFunc(req) == 30
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, os.WriteFile(path, []byte("{default_price: 5, rules: [{path: protected, price: 40}]}"), 0644))
+	select {
+	case err := <-errs:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Invalid pricing file was not reported")
+	}
+	assert.Equal(t, int64(30), table.AmountFunc(req))
+}
@@ -0,0 +1,81 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/middleware"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFreeQuota(t *testing.T) {
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{})
+	lsatmiddleware.FreeQuota = &middleware.FreeQuota{
+		Tracker: middleware.NewSlidingWindowQuota(),
+		Limits:  []middleware.QuotaLimit{{Requests: 2, Window: time.Hour}},
+		KeyFunc: middleware.HeaderQuotaKey("X-Api-Key"),
+	}
+	for name, handler := range strictLsatHandlers(lsatmiddleware) {
+		apiKey := gofight.H{"X-Api-Key": name}
+		for _, expected := range []struct {
+			status    int
+			remaining string
+		}{
+			{http.StatusAccepted, "1"},
+			{http.StatusAccepted, "0"},
+			{http.StatusPaymentRequired, "0"},
+		} {
+			gofight.New().GET("/protected").
+				SetHeader(apiKey).
+				Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+					assert.Equal(t, expected.status, res.Code, name)
+					assert.Equal(t, expected.remaining, res.HeaderMap.Get(middleware.FREE_REQUESTS_REMAINING_HEADER), name)
+				})
+		}
+		// Requests without a key are challenged right away
+		gofight.New().GET("/protected").
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusPaymentRequired, res.Code, name)
+			})
+	}
+}
+
+func TestSlidingWindowQuota(t *testing.T) {
+	ctx := context.Background()
+	quota := middleware.NewSlidingWindowQuota()
+	limits := []middleware.QuotaLimit{
+		{Requests: 1, Window: 50 * time.Millisecond},
+		{Requests: 2, Window: time.Hour},
+	}
+
+	allowed, remaining, err := quota.Allow(ctx, "client", limits)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, int64(0), remaining)
+	allowed, _, _ = quota.Allow(ctx, "client", limits)
+	assert.False(t, allowed)
+
+	// The short window slides, the long one still counts the first request
+	time.Sleep(60 * time.Millisecond)
+	allowed, _, _ = quota.Allow(ctx, "client", limits)
+	assert.True(t, allowed)
+	time.Sleep(60 * time.Millisecond)
+	allowed, _, _ = quota.Allow(ctx, "client", limits)
+	assert.False(t, allowed)
+}
+
+func TestSlidingWindowQuotaForgetsIdleClients(t *testing.T) {
+	ctx := context.Background()
+	quota := middleware.NewSlidingWindowQuota()
+	limits := []middleware.QuotaLimit{{Requests: 1, Window: 20 * time.Millisecond}}
+
+	quota.Allow(ctx, "idle", limits)
+	assert.Equal(t, 1, quota.Len())
+	time.Sleep(30 * time.Millisecond)
+	quota.Allow(ctx, "client", limits)
+	assert.Equal(t, 1, quota.Len())
+}
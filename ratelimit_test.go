@@ -0,0 +1,127 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/middleware"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// testClientKey counts every test request against the same client, as they
+// have no peer address
+func testClientKey(req *http.Request) string {
+	return "client"
+}
+
+func TestChallengeRateLimit(t *testing.T) {
+	lnClient := &MockLNClient{}
+	lsatmiddleware := mockLsatMiddleware(lnClient)
+	lsatmiddleware.ChallengeRateLimit = &middleware.ChallengeRateLimit{
+		Tracker: middleware.NewSlidingWindowQuota(),
+		Limits:  []middleware.QuotaLimit{{Requests: 2, Window: time.Minute}},
+		KeyFunc: testClientKey,
+	}
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	assert.Equal(t, http.StatusTooManyRequests, requestStatus(handler, "/protected", ""))
+	assert.Equal(t, 2, lnClient.Invoices())
+}
+
+func TestChallengeReuse(t *testing.T) {
+	lnClient := &MockLNClient{}
+	lsatmiddleware := mockLsatMiddleware(lnClient)
+	lsatmiddleware.ChallengeReuse = middleware.NewChallengeReuse(time.Minute)
+	lsatmiddleware.ChallengeReuse.KeyFunc = testClientKey
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	_, first := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	_, second := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	assert.Equal(t, first.Get("invoice").String(), second.Get("invoice").String())
+	assert.Equal(t, 1, lnClient.Invoices())
+
+	// Paid invoices aren't handed out again
+	lnClient.Settle()
+	_, third := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	assert.NotEqual(t, first.Get("invoice").String(), third.Get("invoice").String())
+	assert.Equal(t, 2, lnClient.Invoices())
+}
+
+func TestInvoiceLimiter(t *testing.T) {
+	lnClient := &MockLNClient{Delay: 200 * time.Millisecond}
+	lsatmiddleware := mockLsatMiddleware(lnClient)
+	lsatmiddleware.InvoiceLimiter = middleware.NewInvoiceLimiter(1, 0)
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	statuses := make(chan int, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(delay time.Duration) {
+			defer wg.Done()
+			time.Sleep(delay)
+			gofight.New().GET("/protected").
+				Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+					statuses <- res.Code
+				})
+		}(time.Duration(i) * 50 * time.Millisecond)
+	}
+	wg.Wait()
+	close(statuses)
+	codes := []int{}
+	for status := range statuses {
+		codes = append(codes, status)
+	}
+	assert.ElementsMatch(t, []int{http.StatusPaymentRequired, http.StatusServiceUnavailable}, codes)
+	assert.Equal(t, 1, lnClient.Invoices())
+}
+
+func TestChallengeReuseWithoutKeyFunc(t *testing.T) {
+	lnClient := &MockLNClient{}
+	lsatmiddleware := mockLsatMiddleware(lnClient)
+	lsatmiddleware.ChallengeReuse = middleware.NewChallengeReuse(time.Minute)
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	// Requests from the same address aren't taken for the same client
+	for i := 0; i < 2; i++ {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/protected", nil))
+		assert.Equal(t, http.StatusPaymentRequired, res.Code)
+	}
+	assert.Equal(t, 2, lnClient.Invoices())
+}
+
+func TestRateLimitZeroValues(t *testing.T) {
+	lnClient := &MockLNClient{}
+	lsatmiddleware := mockLsatMiddleware(lnClient)
+	lsatmiddleware.ChallengeReuse = &middleware.ChallengeReuse{MaxAge: time.Minute, KeyFunc: testClientKey}
+	lsatmiddleware.InvoiceLimiter = &middleware.InvoiceLimiter{}
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	_, first := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	_, second := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	assert.Equal(t, first.Get("invoice").String(), second.Get("invoice").String())
+	assert.Equal(t, 1, lnClient.Invoices())
+}
+
+func TestChallengeReusePlan(t *testing.T) {
+	lnClient := &MockLNClient{}
+	lsatmiddleware := mockLsatMiddleware(lnClient, withPlan(time.Hour))
+	lsatmiddleware.ChallengeReuse = &middleware.ChallengeReuse{MaxAge: time.Minute, KeyFunc: testClientKey}
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	_, first := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	// The subscription expiry counts from now, in seconds
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	_, second := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	assert.Equal(t, first.Get("invoice").String(), second.Get("invoice").String())
+	assert.Equal(t, 1, lnClient.Invoices())
+}
@@ -0,0 +1,141 @@
+package rates
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	DEFAULT_RATE_TTL             = time.Minute
+	DEFAULT_RATE_MAX_AGE         = 10 * time.Minute
+	DEFAULT_RATE_FAILURE_BACKOFF = 5 * time.Second
+)
+
+// CachedProvider refreshes rates from Provider at most once per TTL and
+// currency. If a refresh fails, the last rate keeps being served until it
+// is MaxAge old, unless FailClosed is set. After a failure Provider isn't
+// asked again for FailureBackoff, doubling with every further failure up
+// to TTL.
+type CachedProvider struct {
+	Provider RateProvider
+	// TTL is DEFAULT_RATE_TTL if zero
+	TTL time.Duration
+	// MaxAge is DEFAULT_RATE_MAX_AGE if zero
+	MaxAge time.Duration
+	// FailureBackoff is DEFAULT_RATE_FAILURE_BACKOFF if zero
+	FailureBackoff time.Duration
+	// FailClosed returns the refresh error instead of a stale rate
+	FailClosed bool
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	// Concurrent requests for the same currency share a single refresh
+	refreshes singleflight.Group
+}
+
+type cacheEntry struct {
+	rate      float64
+	fetchedAt time.Time
+	failures  int
+	failedAt  time.Time
+	err       error
+}
+
+func (cachedProvider *CachedProvider) Rate(ctx context.Context, currency string) (float64, error) {
+	currency = strings.ToUpper(currency)
+	entry := cachedProvider.entry(currency)
+	now := time.Now()
+	if !entry.fetchedAt.IsZero() && now.Sub(entry.fetchedAt) < cachedProvider.ttl() {
+		return entry.rate, nil
+	}
+	if entry.failures > 0 && now.Sub(entry.failedAt) < cachedProvider.backoff(entry.failures) {
+		return cachedProvider.fallback(entry, entry.err)
+	}
+	// The refresh outlives callers giving up, the others still wait for it
+	refresh := cachedProvider.refreshes.DoChan(currency, func() (interface{}, error) {
+		return cachedProvider.refresh(context.WithoutCancel(ctx), currency)
+	})
+	select {
+	case result := <-refresh:
+		if result.Err != nil {
+			return cachedProvider.fallback(cachedProvider.entry(currency), result.Err)
+		}
+		return result.Val.(float64), nil
+	case <-ctx.Done():
+		return cachedProvider.fallback(entry, ctx.Err())
+	}
+}
+
+func (cachedProvider *CachedProvider) refresh(ctx context.Context, currency string) (float64, error) {
+	rate, err := cachedProvider.Provider.Rate(ctx, currency)
+	cachedProvider.mu.Lock()
+	defer cachedProvider.mu.Unlock()
+	entry := cachedProvider.entries[currency]
+	if err != nil {
+		entry.failures++
+		entry.failedAt = time.Now()
+		entry.err = err
+		return 0, err
+	}
+	entry.rate = rate
+	entry.fetchedAt = time.Now()
+	entry.failures = 0
+	entry.err = nil
+	return rate, nil
+}
+
+// fallback returns the stale rate of entry if it may still be served, err
+// otherwise.
+func (cachedProvider *CachedProvider) fallback(entry cacheEntry, err error) (float64, error) {
+	if cachedProvider.FailClosed || entry.fetchedAt.IsZero() || time.Since(entry.fetchedAt) > cachedProvider.maxAge() {
+		return 0, err
+	}
+	return entry.rate, nil
+}
+
+// entry returns a copy of the cache entry of currency.
+func (cachedProvider *CachedProvider) entry(currency string) cacheEntry {
+	cachedProvider.mu.Lock()
+	defer cachedProvider.mu.Unlock()
+	if cachedProvider.entries == nil {
+		cachedProvider.entries = map[string]*cacheEntry{}
+	}
+	entry, ok := cachedProvider.entries[currency]
+	if !ok {
+		entry = &cacheEntry{}
+		cachedProvider.entries[currency] = entry
+	}
+	return *entry
+}
+
+func (cachedProvider *CachedProvider) ttl() time.Duration {
+	if cachedProvider.TTL <= 0 {
+		return DEFAULT_RATE_TTL
+	}
+	return cachedProvider.TTL
+}
+
+func (cachedProvider *CachedProvider) maxAge() time.Duration {
+	if cachedProvider.MaxAge <= 0 {
+		return DEFAULT_RATE_MAX_AGE
+	}
+	return cachedProvider.MaxAge
+}
+
+func (cachedProvider *CachedProvider) backoff(failures int) time.Duration {
+	backoff := cachedProvider.FailureBackoff
+	if backoff <= 0 {
+		backoff = DEFAULT_RATE_FAILURE_BACKOFF
+	}
+	for i := 1; i < failures && backoff < cachedProvider.ttl(); i++ {
+		backoff *= 2
+	}
+	if backoff > cachedProvider.ttl() {
+		return cachedProvider.ttl()
+	}
+	return backoff
+}
@@ -0,0 +1,98 @@
+package rates
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BLOCKCHAIN_INFO_URL = "https://blockchain.info"
+	COINBASE_URL        = "https://api.coinbase.com"
+	// DEFAULT_HTTP_TIMEOUT bounds requests of providers without HTTPClient
+	DEFAULT_HTTP_TIMEOUT = 10 * time.Second
+)
+
+var defaultHTTPClient = &http.Client{Timeout: DEFAULT_HTTP_TIMEOUT}
+
+// BlockchainInfoProvider reads the last price from the blockchain.info ticker.
+type BlockchainInfoProvider struct {
+	// BaseURL is BLOCKCHAIN_INFO_URL if empty
+	BaseURL string
+	// HTTPClient times out after DEFAULT_HTTP_TIMEOUT if nil
+	HTTPClient *http.Client
+}
+
+func (provider *BlockchainInfoProvider) Rate(ctx context.Context, currency string) (float64, error) {
+	ticker := map[string]struct {
+		Last float64 `json:"last"`
+	}{}
+	if err := getJSON(ctx, provider.HTTPClient, orDefault(provider.BaseURL, BLOCKCHAIN_INFO_URL)+"/ticker", &ticker); err != nil {
+		return 0, err
+	}
+	price, ok := ticker[strings.ToUpper(currency)]
+	if !ok {
+		return 0, fmt.Errorf("%w: blockchain.info has no %s price", ErrNoRate, currency)
+	}
+	return price.Last, nil
+}
+
+// CoinbaseProvider reads the spot price from the Coinbase API.
+type CoinbaseProvider struct {
+	// BaseURL is COINBASE_URL if empty
+	BaseURL string
+	// HTTPClient times out after DEFAULT_HTTP_TIMEOUT if nil
+	HTTPClient *http.Client
+}
+
+func (provider *CoinbaseProvider) Rate(ctx context.Context, currency string) (float64, error) {
+	spot := struct {
+		Data struct {
+			Amount string `json:"amount"`
+		} `json:"data"`
+	}{}
+	url := fmt.Sprintf("%s/v2/prices/BTC-%s/spot", orDefault(provider.BaseURL, COINBASE_URL), strings.ToUpper(currency))
+	if err := getJSON(ctx, provider.HTTPClient, url, &spot); err != nil {
+		return 0, err
+	}
+	rate, err := strconv.ParseFloat(spot.Data.Amount, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: coinbase returned %q", ErrNoRate, spot.Data.Amount)
+	}
+	return rate, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, result interface{}) error {
+	if client == nil {
+		client = defaultHTTPClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %s", ErrNoRate, url, res.Status)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, result)
+}
+
+func orDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
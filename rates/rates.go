@@ -0,0 +1,123 @@
+package rates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+const (
+	SATS_PER_BTC = 100000000
+	MSAT_PER_SAT = 1000
+)
+
+var ErrNoRate = errors.New("No exchange rate available")
+
+// RateProvider returns the price of one BTC in currency, e.g. "USD".
+type RateProvider interface {
+	Rate(ctx context.Context, currency string) (float64, error)
+}
+
+// MedianProvider asks all Providers concurrently and returns the median of
+// their rates, so that a single source can't skew the price.
+type MedianProvider struct {
+	Providers []RateProvider
+	// MinSources is the number of providers that have to answer, 1 if zero
+	MinSources int
+}
+
+func (medianProvider *MedianProvider) Rate(ctx context.Context, currency string) (float64, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	rates := make([]float64, 0, len(medianProvider.Providers))
+	errs := make([]string, 0)
+	for _, provider := range medianProvider.Providers {
+		wg.Add(1)
+		go func(provider RateProvider) {
+			defer wg.Done()
+			rate, err := provider.Rate(ctx, currency)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err.Error())
+				return
+			}
+			rates = append(rates, rate)
+		}(provider)
+	}
+	wg.Wait()
+
+	minSources := medianProvider.MinSources
+	if minSources < 1 {
+		minSources = 1
+	}
+	if len(rates) < minSources {
+		return 0, fmt.Errorf("%w: %d of %d sources answered: %s", ErrNoRate, len(rates), minSources, strings.Join(errs, "; "))
+	}
+	sort.Float64s(rates)
+	middle := len(rates) / 2
+	if len(rates)%2 == 0 {
+		return (rates[middle-1] + rates[middle]) / 2, nil
+	}
+	return rates[middle], nil
+}
+
+// FiatAmount prices requests in cents of a fiat currency.
+type FiatAmount struct {
+	Provider RateProvider
+	Currency string
+	Cents    int64
+	// CentsFunc prices each request, overriding Cents
+	CentsFunc func(req *http.Request) int64
+	// FallbackSats is charged by AmountFunc when no rate is available
+	FallbackSats int64
+	// OnError is called by AmountFunc when it falls back
+	OnError func(error)
+}
+
+// AmountMsat converts the price of req to msat, rounding up. It fails
+// when no rate is available, so it can be set as
+// LsatMiddleware.AmountMsatFunc to reject requests instead of guessing.
+func (fiatAmount *FiatAmount) AmountMsat(req *http.Request) (lnwire.MilliSatoshi, error) {
+	cents := fiatAmount.Cents
+	if fiatAmount.CentsFunc != nil {
+		cents = fiatAmount.CentsFunc(req)
+	}
+	rate, err := fiatAmount.Provider.Rate(req.Context(), fiatAmount.Currency)
+	if err != nil {
+		return 0, err
+	}
+	if rate <= 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return 0, fmt.Errorf("%w: invalid rate %f", ErrNoRate, rate)
+	}
+	return lnwire.MilliSatoshi(math.Ceil(float64(cents) * SATS_PER_BTC * MSAT_PER_SAT / (100 * rate))), nil
+}
+
+// Amount is AmountMsat rounded up to whole sats.
+func (fiatAmount *FiatAmount) Amount(req *http.Request) (int64, error) {
+	amountMsat, err := fiatAmount.AmountMsat(req)
+	if err != nil {
+		return 0, err
+	}
+	return int64((amountMsat + MSAT_PER_SAT - 1) / MSAT_PER_SAT), nil
+}
+
+// AmountFunc can be set as LsatMiddleware.AmountFunc. It charges
+// FallbackSats when no rate is available, use Amount to fail instead.
+func (fiatAmount *FiatAmount) AmountFunc(req *http.Request) int64 {
+	amount, err := fiatAmount.Amount(req)
+	if err != nil {
+		if fiatAmount.OnError != nil {
+			fiatAmount.OnError(err)
+		}
+		return fiatAmount.FallbackSats
+	}
+	return amount
+}
@@ -0,0 +1,189 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/rates"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubRateProvider struct {
+	rate  float64
+	err   error
+	calls int32
+}
+
+func (provider *stubRateProvider) Rate(ctx context.Context, currency string) (float64, error) {
+	atomic.AddInt32(&provider.calls, 1)
+	return provider.rate, provider.err
+}
+
+func TestRateProviders(t *testing.T) {
+	blockchainInfo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/ticker", req.URL.Path)
+		fmt.Fprint(w, `{"USD": {"last": 50000.5, "symbol": "$"}, "EUR": {"last": 45000, "symbol": "€"}}`)
+	}))
+	defer blockchainInfo.Close()
+	coinbase := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/v2/prices/BTC-USD/spot", req.URL.Path)
+		fmt.Fprint(w, `{"data": {"base": "BTC", "currency": "USD", "amount": "52000.00"}}`)
+	}))
+	defer coinbase.Close()
+
+	rate, err := (&rates.BlockchainInfoProvider{BaseURL: blockchainInfo.URL}).Rate(context.Background(), "eur")
+	assert.NoError(t, err)
+	assert.Equal(t, 45000.0, rate)
+	_, err = (&rates.BlockchainInfoProvider{BaseURL: blockchainInfo.URL}).Rate(context.Background(), "XYZ")
+	assert.ErrorIs(t, err, rates.ErrNoRate)
+	rate, err = (&rates.CoinbaseProvider{BaseURL: coinbase.URL}).Rate(context.Background(), "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, 52000.0, rate)
+
+	median := &rates.MedianProvider{
+		Providers: []rates.RateProvider{
+			&rates.BlockchainInfoProvider{BaseURL: blockchainInfo.URL},
+			&rates.CoinbaseProvider{BaseURL: coinbase.URL},
+			&stubRateProvider{rate: 51000},
+			&stubRateProvider{err: errors.New("down")},
+		},
+		MinSources: 3,
+	}
+	rate, err = median.Rate(context.Background(), "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, 51000.0, rate)
+
+	median.MinSources = 4
+	_, err = median.Rate(context.Background(), "USD")
+	assert.ErrorIs(t, err, rates.ErrNoRate)
+}
+
+func TestCachedRateProvider(t *testing.T) {
+	stub := &stubRateProvider{rate: 50000}
+	cached := &rates.CachedProvider{Provider: stub, TTL: 20 * time.Millisecond, MaxAge: 100 * time.Millisecond}
+
+	for i := 0; i < 3; i++ {
+		rate, err := cached.Rate(context.Background(), "USD")
+		assert.NoError(t, err)
+		assert.Equal(t, 50000.0, rate)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&stub.calls))
+
+	// A failed refresh serves the stale rate until MaxAge
+	stub.err = errors.New("down")
+	time.Sleep(30 * time.Millisecond)
+	rate, err := cached.Rate(context.Background(), "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, 50000.0, rate)
+	time.Sleep(100 * time.Millisecond)
+	_, err = cached.Rate(context.Background(), "USD")
+	assert.Error(t, err)
+
+	failClosed := &rates.CachedProvider{Provider: &stubRateProvider{rate: 50000}, TTL: 20 * time.Millisecond, FailClosed: true}
+	_, err = failClosed.Rate(context.Background(), "USD")
+	assert.NoError(t, err)
+	failClosed.Provider.(*stubRateProvider).err = errors.New("down")
+	time.Sleep(30 * time.Millisecond)
+	_, err = failClosed.Rate(context.Background(), "USD")
+	assert.Error(t, err)
+}
+
+func TestCachedRateProviderBackoff(t *testing.T) {
+	stub := &stubRateProvider{err: errors.New("down")}
+	cached := &rates.CachedProvider{Provider: stub, FailureBackoff: 50 * time.Millisecond}
+
+	// Failures aren't retried until the backoff has passed
+	for i := 0; i < 3; i++ {
+		_, err := cached.Rate(context.Background(), "USD")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&stub.calls))
+	time.Sleep(60 * time.Millisecond)
+	_, err := cached.Rate(context.Background(), "USD")
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&stub.calls))
+}
+
+// slowRateProvider answers once release is closed
+type slowRateProvider struct {
+	stubRateProvider
+	release chan struct{}
+}
+
+func (provider *slowRateProvider) Rate(ctx context.Context, currency string) (float64, error) {
+	<-provider.release
+	return provider.stubRateProvider.Rate(ctx, currency)
+}
+
+func TestCachedRateProviderSingleRefresh(t *testing.T) {
+	slow := &slowRateProvider{stubRateProvider: stubRateProvider{rate: 50000}, release: make(chan struct{})}
+	cached := &rates.CachedProvider{Provider: slow}
+
+	// Callers giving up don't wait for the refresh
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := cached.Rate(ctx, "USD")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rate, err := cached.Rate(context.Background(), "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, 50000.0, rate)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(slow.release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slow.calls))
+}
+
+func TestFiatAmount(t *testing.T) {
+	stub := &stubRateProvider{rate: 40000}
+	var fallbackErr error
+	fiatAmount := &rates.FiatAmount{
+		Provider:     stub,
+		Currency:     "USD",
+		Cents:        1,
+		FallbackSats: 7,
+		OnError: func(err error) {
+			fallbackErr = err
+		},
+	}
+	req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+
+	// 1 cent at 40000 USD/BTC is exactly 25 sats, 3 cents 75
+	assert.Equal(t, int64(25), fiatAmount.AmountFunc(req))
+	fiatAmount.CentsFunc = func(req *http.Request) int64 {
+		return 3
+	}
+	assert.Equal(t, int64(75), fiatAmount.AmountFunc(req))
+	stub.rate = 30000
+	assert.Equal(t, int64(100), fiatAmount.AmountFunc(req))
+	stub.rate = 70000
+	// 42.86 sats are rounded up
+	assert.Equal(t, int64(43), fiatAmount.AmountFunc(req))
+
+	// 1 cent at 70000 USD/BTC is 14285.71 msat
+	amountMsat, err := (&rates.FiatAmount{Provider: stub, Currency: "USD", Cents: 1}).AmountMsat(req)
+	assert.NoError(t, err)
+	assert.Equal(t, lnwire.MilliSatoshi(14286), amountMsat)
+
+	stub.err = errors.New("down")
+	assert.Equal(t, int64(7), fiatAmount.AmountFunc(req))
+	assert.Error(t, fallbackErr)
+	_, err = fiatAmount.Amount(req)
+	assert.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/getAlby/lsat-middleware/echolsat"
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/lsat"
+	"github.com/getAlby/lsat-middleware/middleware"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func negotiatingLsatMiddleware() *middleware.LsatMiddleware {
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{})
+	lsatmiddleware.ResponseRenderer = &middleware.NegotiatingRenderer{
+		Renderers: map[string]middleware.ResponseRenderer{
+			middleware.CONTENT_TYPE_PROBLEM: &middleware.ProblemRenderer{},
+			"text/*": middleware.ResponseRendererFunc(func(w http.ResponseWriter, req *http.Request, response *middleware.Response) error {
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(response.Status)
+				_, err := fmt.Fprint(w, response.Message)
+				return err
+			}),
+		},
+	}
+	return lsatmiddleware
+}
+
+func TestResponseRenderer(t *testing.T) {
+	handlers := []http.Handler{
+		ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *negotiatingLsatMiddleware()}),
+		echoStrictLsatHandler(&echolsat.EchoLsat{Middleware: *negotiatingLsatMiddleware()}),
+	}
+	for _, handler := range handlers {
+		router := gofight.New()
+
+		router.GET("/protected").
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				body := res.Body.String()
+
+				assert.Equal(t, http.StatusPaymentRequired, res.Code)
+				assert.Equal(t, "application/json; charset=utf-8", res.HeaderMap.Get("Content-Type"))
+				assert.Equal(t, lsat.PAYMENT_REQUIRED_MESSAGE, gjson.Get(body, "message").String())
+				assert.Equal(t, int64(10), gjson.Get(body, "amount").Int())
+				assert.NotEmpty(t, gjson.Get(body, "invoice").String())
+				assert.Len(t, gjson.Get(body, "payment_hash").String(), 64)
+				assert.NotEmpty(t, gjson.Get(body, "expires_at").String())
+			})
+
+		router.GET("/protected").
+			SetHeader(gofight.H{
+				"Accept": "text/html;q=0.5, application/problem+json",
+			}).
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				body := res.Body.String()
+
+				assert.Equal(t, http.StatusPaymentRequired, res.Code)
+				assert.Equal(t, "application/problem+json; charset=utf-8", res.HeaderMap.Get("Content-Type"))
+				assert.Equal(t, "about:blank", gjson.Get(body, "type").String())
+				assert.Equal(t, int64(http.StatusPaymentRequired), gjson.Get(body, "status").Int())
+				assert.NotEmpty(t, gjson.Get(body, "invoice").String())
+			})
+
+		router.GET("/protected").
+			SetHeader(gofight.H{
+				"Accept":        "text/html",
+				"Authorization": "LSAT not-a-token",
+			}).
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusUnauthorized, res.Code)
+				assert.Equal(t, "text/plain", res.HeaderMap.Get("Content-Type"))
+			})
+	}
+}
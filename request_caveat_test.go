@@ -0,0 +1,113 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/lsat"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func TestRequestCaveatBuilders(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://Example.com/api/v1/items?account=alice", nil)
+	req.Header.Set("X-Tenant", "acme=1")
+	req.RemoteAddr = "192.0.2.10:4321"
+
+	requestCaveats := []caveat.RequestCaveat{
+		caveat.PathPrefix("/api"),
+		caveat.Methods("get", "head"),
+		caveat.Host(),
+		caveat.QueryParam("account"),
+		caveat.Header("X-Tenant"),
+		caveat.ClientCIDR(24, 64, nil),
+	}
+	caveats, err := caveat.Mint(requestCaveats, req)
+	assert.NoError(t, err)
+	assert.Equal(t, []caveat.Caveat{
+		caveat.NewCaveat(caveat.PATH_PREFIX, "/api"),
+		caveat.NewCaveat(caveat.METHODS, "GET,HEAD"),
+		caveat.NewCaveat(caveat.HOST, "example.com"),
+		caveat.NewCaveat("query_account", "alice"),
+		caveat.NewCaveat("header_x-tenant", "acme=1"),
+		caveat.NewCaveat(caveat.CLIENT_CIDR, "192.0.2.0/24"),
+	}, caveats)
+	assert.NoError(t, caveat.Satisfy(caveats, requestCaveats, req))
+
+	// Values containing '=' survive encoding
+	decoded, err := caveat.DecodeCaveat(caveat.EncodeCaveat(caveats[4]))
+	assert.NoError(t, err)
+	assert.Equal(t, caveats[4], decoded)
+
+	for i := range caveats {
+		assert.Error(t, caveat.Satisfy(caveats[i:i+1], requestCaveats, func() *http.Request {
+			mismatch := req.Clone(req.Context())
+			switch i {
+			case 0:
+				mismatch.URL.Path = "/apis"
+			case 1:
+				mismatch.Method = http.MethodPost
+			case 2:
+				mismatch.Host = "other.com"
+			case 3:
+				mismatch.URL.RawQuery = "account=bob"
+			case 4:
+				mismatch.Header.Set("X-Tenant", "acme=2")
+			case 5:
+				mismatch.RemoteAddr = "198.51.100.1:4321"
+			}
+			return mismatch
+		}()))
+	}
+
+	_, err = caveat.Mint([]caveat.RequestCaveat{caveat.PathPrefix("/admin")}, req)
+	assert.Error(t, err)
+}
+
+func TestRequestCaveatsMiddleware(t *testing.T) {
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{})
+	lsatmiddleware.RequestCaveats = []caveat.RequestCaveat{caveat.Header("X-Account")}
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	var macaroonString string
+	gofight.New().GET("/protected").
+		SetHeader(gofight.H{"X-Account": "alice"}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPaymentRequired, res.Code)
+			macaroonString = gjson.Get(res.Body.String(), "macaroon").String()
+		})
+	authorization := fmt.Sprintf("LSAT %s:%s", macaroonString, TEST_PREIMAGE_VALID)
+
+	gofight.New().GET("/protected").
+		SetHeader(gofight.H{"X-Account": "alice", "Authorization": authorization}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusAccepted, res.Code)
+		})
+
+	gofight.New().GET("/protected").
+		SetHeader(gofight.H{"X-Account": "bob", "Authorization": authorization}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPaymentRequired, res.Code)
+		})
+}
+
+func TestCaveatsFuncError(t *testing.T) {
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{})
+	lsatmiddleware.CaveatsFunc = func(req *http.Request) ([]caveat.Caveat, error) {
+		return nil, errors.New("Account lookup failed")
+	}
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	gofight.New().GET("/protected").
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusInternalServerError, res.Code)
+			assert.Contains(t, gjson.Get(res.Body.String(), "message").String(), lsat.ErrCaveats.Error())
+		})
+}
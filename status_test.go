@@ -0,0 +1,168 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/ln"
+	macaroonutils "github.com/getAlby/lsat-middleware/macaroon"
+	"github.com/getAlby/lsat-middleware/middleware"
+	"github.com/getAlby/lsat-middleware/utils"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+	"google.golang.org/grpc"
+)
+
+type addInvoiceOnlyClient struct{}
+
+func (client *addInvoiceOnlyClient) AddInvoice(ctx context.Context, lnInvoice *lnrpc.Invoice, httpReq *http.Request, options ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error) {
+	return (&MockLNClient{}).AddInvoice(ctx, lnInvoice, httpReq, options...)
+}
+
+// withStatusPolling checks on invoices every 10ms while waiting
+func withStatusPolling() TestOption {
+	return func(lsatmiddleware *middleware.LsatMiddleware) {
+		lsatmiddleware.StatusPollInterval = 10 * time.Millisecond
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	preimage, err := utils.GetPreimageFromString(TEST_PREIMAGE_VALID)
+	assert.NoError(t, err)
+	macaroonString, err := macaroonutils.GetMacaroonAsString(preimage.Hash(), 10000, nil, []byte(ROOT_KEY))
+	assert.NoError(t, err)
+
+	lnClient := &MockLNClient{}
+	handlers := strictLsatHandlers(mockLsatMiddleware(lnClient, withCookie(), withStatusPolling()))
+	for _, handler := range handlers {
+		gofight.New().GET("/lsat/status").
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusBadRequest, res.Code)
+			})
+
+		gofight.New().GET("/lsat/status?payment_hash="+preimage.Hash().String()).
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				body := res.Body.String()
+
+				assert.Equal(t, http.StatusOK, res.Code)
+				assert.Equal(t, middleware.INVOICE_STATUS_PENDING, gjson.Get(body, "status").String())
+				assert.False(t, gjson.Get(body, "ready").Bool())
+			})
+	}
+
+	// Long poll until the invoice gets paid
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		lnClient.Settle()
+	}()
+	gofight.New().GET("/lsat/status?wait=5&macaroon="+url.QueryEscape(macaroonString)).
+		Run(handlers["gin"], func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			body := res.Body.String()
+
+			assert.Equal(t, http.StatusOK, res.Code)
+			assert.Equal(t, middleware.INVOICE_STATUS_SETTLED, gjson.Get(body, "status").String())
+			assert.True(t, gjson.Get(body, "ready").Bool())
+			assert.NotContains(t, body, TEST_PREIMAGE_VALID)
+			assert.Empty(t, res.HeaderMap.Get("Set-Cookie"))
+		})
+}
+
+func TestStatusHandlerEvents(t *testing.T) {
+	preimage, err := utils.GetPreimageFromString(TEST_PREIMAGE_VALID)
+	assert.NoError(t, err)
+
+	lnClient := &MockLNClient{}
+	lsatmiddleware := mockLsatMiddleware(lnClient, withCookie(), withStatusPolling())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		lnClient.Settle()
+	}()
+	gofight.New().GET("/lsat/status?payment_hash="+preimage.Hash().String()).
+		SetHeader(gofight.H{
+			"Accept": middleware.CONTENT_TYPE_EVENT_STREAM,
+		}).
+		Run(http.HandlerFunc(lsatmiddleware.StatusHandler), func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			events := strings.Split(strings.TrimSpace(res.Body.String()), "\n\n")
+
+			assert.Equal(t, http.StatusOK, res.Code)
+			assert.Equal(t, middleware.CONTENT_TYPE_EVENT_STREAM, res.HeaderMap.Get("Content-Type"))
+			assert.Len(t, events, 2)
+			assert.Contains(t, events[0], `"status":"pending"`)
+			assert.Contains(t, events[1], `"status":"settled"`)
+		})
+}
+
+func TestStatusHandlerLookupUnsupported(t *testing.T) {
+	preimage, err := utils.GetPreimageFromString(TEST_PREIMAGE_VALID)
+	assert.NoError(t, err)
+
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{})
+	lsatmiddleware.LNClient = &addInvoiceOnlyClient{}
+	gofight.New().GET("/lsat/status?payment_hash="+preimage.Hash().String()).
+		Run(http.HandlerFunc(lsatmiddleware.StatusHandler), func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusNotImplemented, res.Code)
+		})
+}
+
+func TestStatusHandlerOnlyChallengeInvoices(t *testing.T) {
+	otherPreimage, err := utils.GetPreimageFromString(TEST_PREIMAGE_INVALID)
+	assert.NoError(t, err)
+	unknownPreimage, err := utils.GetPreimageFromString(TEST_MACAROON_WITHOUT_CAVEATS_PREIMAGE)
+	assert.NoError(t, err)
+
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{}, withCookie(), withStatusPolling())
+	lsatmiddleware.InvoiceStore = ln.NewMemoryInvoiceStore()
+	err = lsatmiddleware.InvoiceStore.PutInvoice(context.Background(), &ln.InvoiceState{
+		PaymentHash: otherPreimage.Hash(),
+		Memo:        "Coffee",
+		State:       lnrpc.Invoice_SETTLED,
+	})
+	assert.NoError(t, err)
+
+	// Invoices that aren't challenges look the same as unknown ones
+	bodies := []string{}
+	for _, paymentHash := range []string{otherPreimage.Hash().String(), unknownPreimage.Hash().String()} {
+		gofight.New().GET("/lsat/status?payment_hash="+paymentHash).
+			Run(http.HandlerFunc(lsatmiddleware.StatusHandler), func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusNotFound, res.Code)
+				bodies = append(bodies, res.Body.String())
+			})
+	}
+	assert.Equal(t, bodies[0], bodies[1])
+}
+
+func TestStatusHandlerWaiters(t *testing.T) {
+	preimage, err := utils.GetPreimageFromString(TEST_PREIMAGE_VALID)
+	assert.NoError(t, err)
+
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{}, withCookie(), withStatusPolling())
+	lsatmiddleware.StatusWaiters = middleware.NewInvoiceLimiter(1, 0)
+	handler := http.HandlerFunc(lsatmiddleware.StatusHandler)
+
+	waiting := make(chan struct{})
+	go func() {
+		defer close(waiting)
+		gofight.New().GET("/lsat/status?wait=1&payment_hash="+preimage.Hash().String()).
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusOK, res.Code)
+			})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	gofight.New().GET("/lsat/status?wait=1&payment_hash="+preimage.Hash().String()).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+		})
+	// Requests that don't wait aren't capped
+	gofight.New().GET("/lsat/status?payment_hash="+preimage.Hash().String()).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, res.Code)
+		})
+	<-waiting
+}
@@ -0,0 +1,89 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/getAlby/lsat-middleware/echolsat"
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/lsat"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func runStrictHandlerTests(t *testing.T, handler http.Handler) {
+	router := gofight.New()
+
+	router.GET("/protected").
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			message := fmt.Sprint(gjson.Get(res.Body.String(), "message"))
+
+			assert.Equal(t, lsat.PAYMENT_REQUIRED_MESSAGE, message)
+			assert.Equal(t, http.StatusPaymentRequired, res.Code)
+			assert.True(t, strings.HasPrefix(res.HeaderMap.Get("Www-Authenticate"), "LSAT macaroon="))
+		})
+
+	router.GET("/protected").
+		SetHeader(gofight.H{
+			"Authorization": "LSAT not-a-token",
+		}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusUnauthorized, res.Code)
+		})
+
+	router.GET("/protected").
+		SetHeader(gofight.H{
+			"Authorization": fmt.Sprintf("LSAT %s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_INVALID),
+		}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPaymentRequired, res.Code)
+			assert.True(t, strings.HasPrefix(res.HeaderMap.Get("Www-Authenticate"), "LSAT macaroon="))
+		})
+
+	router.GET("/protected").
+		SetHeader(gofight.H{
+			"Authorization": fmt.Sprintf("LSAT %s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_VALID),
+		}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			message := fmt.Sprint(gjson.Get(res.Body.String(), "message"))
+
+			assert.Equal(t, lsat.PROTECTED_CONTENT_MESSAGE, message)
+			assert.Equal(t, http.StatusAccepted, res.Code)
+		})
+}
+
+func TestGinLsatStrictHandler(t *testing.T) {
+	ginlsatmiddleware := &ginlsat.GinLsat{
+		Middleware: *mockLsatMiddleware(&MockLNClient{}),
+	}
+	runStrictHandlerTests(t, ginStrictLsatHandler(ginlsatmiddleware))
+}
+
+func TestEchoLsatStrictHandler(t *testing.T) {
+	echolsatmiddleware := &echolsat.EchoLsat{
+		Middleware: *mockLsatMiddleware(&MockLNClient{}),
+	}
+	runStrictHandlerTests(t, echoStrictLsatHandler(echolsatmiddleware))
+}
+
+func TestStrictHandlerInvoiceError(t *testing.T) {
+	lnClient := &MockLNClient{Err: errors.New("node offline")}
+	handlers := []http.Handler{
+		ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *mockLsatMiddleware(lnClient)}),
+		echoStrictLsatHandler(&echolsat.EchoLsat{Middleware: *mockLsatMiddleware(lnClient)}),
+	}
+	for _, handler := range handlers {
+		gofight.New().GET("/protected").
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				message := fmt.Sprint(gjson.Get(res.Body.String(), "message"))
+
+				assert.Equal(t, http.StatusInternalServerError, res.Code)
+				assert.True(t, strings.HasPrefix(message, lsat.ErrInvoiceCreation.Error()))
+			})
+	}
+}
@@ -0,0 +1,116 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/ln"
+	"github.com/getAlby/lsat-middleware/middleware"
+	"github.com/getAlby/lsat-middleware/utils"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+type mockInvoiceStream struct {
+	grpc.ClientStream
+	ctx      context.Context
+	invoices []*lnrpc.Invoice
+	err      error
+}
+
+func (stream *mockInvoiceStream) Recv() (*lnrpc.Invoice, error) {
+	if len(stream.invoices) > 0 {
+		invoice := stream.invoices[0]
+		stream.invoices = stream.invoices[1:]
+		return invoice, nil
+	}
+	if stream.err != nil {
+		return nil, stream.err
+	}
+	<-stream.ctx.Done()
+	return nil, stream.ctx.Err()
+}
+
+// subscribingLNClient serves one stream per subscription and records the
+// subscription requests
+type subscribingLNClient struct {
+	MockLNClient
+	mu       sync.Mutex
+	streams  []*mockInvoiceStream
+	requests []*lnrpc.InvoiceSubscription
+}
+
+func (client *subscribingLNClient) SubscribeInvoices(ctx context.Context, in *lnrpc.InvoiceSubscription, options ...grpc.CallOption) (lnrpc.Lightning_SubscribeInvoicesClient, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.requests = append(client.requests, in)
+	stream := client.streams[0]
+	if len(client.streams) > 1 {
+		client.streams = client.streams[1:]
+	}
+	stream.ctx = ctx
+	return stream, nil
+}
+
+func TestSubscribeInvoices(t *testing.T) {
+	preimage, err := utils.GetPreimageFromString(TEST_PREIMAGE_VALID)
+	assert.NoError(t, err)
+	paymentHash := preimage.Hash()
+	now := time.Now().Unix()
+
+	lnClient := &subscribingLNClient{
+		streams: []*mockInvoiceStream{
+			{
+				invoices: []*lnrpc.Invoice{
+					{RHash: paymentHash[:], Memo: middleware.INVOICE_MEMO, State: lnrpc.Invoice_OPEN, AddIndex: 1, CreationDate: now, Expiry: 3600},
+					{RHash: make([]byte, 32), Memo: "coffee", State: lnrpc.Invoice_OPEN, AddIndex: 2, CreationDate: now, Expiry: 3600},
+				},
+				err: errors.New("connection reset"),
+			},
+			{
+				invoices: []*lnrpc.Invoice{
+					{RHash: paymentHash[:], Memo: middleware.INVOICE_MEMO, State: lnrpc.Invoice_SETTLED, RPreimage: preimage[:], AddIndex: 1, SettleIndex: 1, CreationDate: now, Expiry: 3600, SettleDate: now, AmtPaidMsat: 10000},
+				},
+			},
+		},
+	}
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{})
+	lsatmiddleware.LNClient = lnClient
+	lsatmiddleware.InvoiceStore = ln.NewMemoryInvoiceStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := make(chan *ln.InvoiceState, 10)
+	done := make(chan error)
+	go func() {
+		done <- lsatmiddleware.SubscribeInvoices(ctx, func(invoiceState *ln.InvoiceState) {
+			updates <- invoiceState
+		})
+	}()
+
+	assert.Equal(t, lnrpc.Invoice_OPEN, (<-updates).State)
+	settled := <-updates
+	assert.True(t, settled.IsSettled())
+	assert.Equal(t, preimage, settled.Preimage)
+	assert.Equal(t, int64(10000), settled.AmountPaidMsat)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	// The second subscription resumed after the skipped invoice
+	lnClient.mu.Lock()
+	assert.Len(t, lnClient.requests, 2)
+	assert.Equal(t, uint64(2), lnClient.requests[1].AddIndex)
+	lnClient.mu.Unlock()
+
+	invoiceStatus, err := lsatmiddleware.GetInvoiceStatus(context.Background(), paymentHash)
+	assert.NoError(t, err)
+	assert.Equal(t, middleware.INVOICE_STATUS_SETTLED, invoiceStatus.Status)
+
+	_, err = lsatmiddleware.InvoiceStore.GetInvoice(context.Background(), [32]byte{})
+	assert.ErrorIs(t, err, ln.ErrInvoiceNotFound)
+}
@@ -1,13 +1,40 @@
 package test
 
 import (
+	"context"
+	"crypto/rand"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"strconv"
-)
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/echolsat"
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/ln"
+	"github.com/getAlby/lsat-middleware/lsat"
+	macaroonutils "github.com/getAlby/lsat-middleware/macaroon"
+	"github.com/getAlby/lsat-middleware/middleware"
+	"github.com/getAlby/lsat-middleware/rates"
+	"github.com/getAlby/lsat-middleware/tier"
+	"github.com/getAlby/lsat-middleware/utils"
 
-const SATS_PER_BTC = 100000000
+	"github.com/appleboy/gofight/v2"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/echo/v4"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+	"google.golang.org/grpc"
+)
 
 const MIN_SATS_TO_BE_PAID = 1
 
@@ -31,29 +58,322 @@ func FiatToBTC(currency string, value float64) *http.Request {
 	return req
 }
 
-type FiatRateConfig struct {
-	Currency string
-	Amount   float64
+// fiatRateProvider is shared so that the integration tests don't fetch a
+// rate for every challenge
+var fiatRateProvider = &rates.CachedProvider{
+	Provider: &rates.BlockchainInfoProvider{},
+}
+
+// MockLNClient hands out invoices for TEST_PREIMAGE_VALID without talking to a node,
+// or with UniquePreimages for a preimage of their own
+type MockLNClient struct {
+	Err error
+	// Delay slows down AddInvoice like a remote node
+	Delay time.Duration
+	// UniquePreimages gives every invoice its own preimage, see Preimage
+	UniquePreimages bool
+
+	mu        sync.Mutex
+	settled   bool
+	invoices  int
+	preimages map[lntypes.Hash]lntypes.Preimage
+}
+
+// Preimage returns the preimage paying the invoice for paymentHash
+func (client *MockLNClient) Preimage(paymentHash lntypes.Hash) (lntypes.Preimage, bool) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if preimage, ok := client.preimages[paymentHash]; ok {
+		return preimage, true
+	}
+	preimage, err := lntypes.MakePreimageFromStr(TEST_PREIMAGE_VALID)
+	if err != nil || preimage.Hash() != paymentHash {
+		return lntypes.Preimage{}, false
+	}
+	return preimage, true
+}
+
+func (client *MockLNClient) newPreimage() (lntypes.Preimage, error) {
+	if !client.UniquePreimages {
+		return lntypes.MakePreimageFromStr(TEST_PREIMAGE_VALID)
+	}
+	var preimage lntypes.Preimage
+	if _, err := rand.Read(preimage[:]); err != nil {
+		return lntypes.Preimage{}, err
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.preimages == nil {
+		client.preimages = make(map[lntypes.Hash]lntypes.Preimage)
+	}
+	client.preimages[preimage.Hash()] = preimage
+	return preimage, nil
+}
+
+// Invoices returns how many invoices the client was asked to create
+func (client *MockLNClient) Invoices() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.invoices
+}
+
+// Settle marks the invoices of the client as paid
+func (client *MockLNClient) Settle() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.settled = true
+}
+
+func (client *MockLNClient) LookupInvoice(ctx context.Context, paymentHash lntypes.Hash, options ...grpc.CallOption) (*lnrpc.Invoice, error) {
+	if client.Err != nil {
+		return nil, client.Err
+	}
+	preimage, ok := client.Preimage(paymentHash)
+	if !ok {
+		return nil, ln.ErrInvoiceNotFound
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	invoice := &lnrpc.Invoice{
+		RHash:        paymentHash[:],
+		Memo:         "LSAT",
+		CreationDate: time.Now().Unix(),
+		Expiry:       3600,
+		State:        lnrpc.Invoice_OPEN,
+	}
+	if client.settled {
+		invoice.State = lnrpc.Invoice_SETTLED
+		invoice.RPreimage = preimage[:]
+	}
+	return invoice, nil
 }
 
-func (fr *FiatRateConfig) FiatToBTCAmountFunc(req *http.Request) (amount int64) {
-	if req == nil {
-		return MIN_SATS_TO_BE_PAID
+func (client *MockLNClient) AddInvoice(ctx context.Context, lnInvoice *lnrpc.Invoice, httpReq *http.Request, options ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error) {
+	client.mu.Lock()
+	client.invoices++
+	client.mu.Unlock()
+	time.Sleep(client.Delay)
+	if client.Err != nil {
+		return nil, client.Err
 	}
-	res, err := http.Get(fmt.Sprintf("https://blockchain.info/tobtc?currency=%s&value=%f", fr.Currency, fr.Amount))
+	preimage, err := client.newPreimage()
 	if err != nil {
-		return MIN_SATS_TO_BE_PAID
+		return nil, err
 	}
-	defer res.Body.Close()
+	paymentHash := preimage.Hash()
+	paymentRequest, err := NewTestInvoice(paymentHash, ln.InvoiceAmountMsat(lnInvoice))
+	if err != nil {
+		return nil, err
+	}
+	return &lnrpc.AddInvoiceResponse{
+		RHash:          paymentHash[:],
+		PaymentRequest: paymentRequest,
+	}, nil
+}
 
-	amountBits, err := ioutil.ReadAll(res.Body)
+// NewTestInvoice encodes a regtest invoice signed by a throwaway node key
+func NewTestInvoice(paymentHash lntypes.Hash, amountMsat lnwire.MilliSatoshi) (string, error) {
+	privKey, err := btcec.NewPrivateKey()
 	if err != nil {
-		return MIN_SATS_TO_BE_PAID
+		return "", err
 	}
-	amountInBTC, err := strconv.ParseFloat(string(amountBits), 32)
+	invoice, err := zpay32.NewInvoice(&chaincfg.RegressionNetParams, paymentHash, time.Now(),
+		zpay32.Amount(amountMsat),
+		zpay32.Description("LSAT"),
+		zpay32.Expiry(time.Hour),
+	)
 	if err != nil {
-		return MIN_SATS_TO_BE_PAID
+		return "", err
+	}
+	return invoice.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			return ecdsa.SignCompact(privKey, chainhash.HashB(msg), true)
+		},
+	})
+}
+
+func FixedAmountFunc(req *http.Request) int64 {
+	return 10
+}
+
+func PathCaveat(req *http.Request) []caveat.Caveat {
+	return []caveat.Caveat{
+		{
+			Condition: "RequestPath",
+			Value:     req.URL.Path,
+		},
+	}
+}
+
+var testTiers = []tier.Tier{
+	{Service: "api", Name: "basic", Level: 0, Capabilities: []string{"read"}, Price: 10},
+	{Service: "api", Name: "premium", Level: 1, Capabilities: []string{"read", "write"}, Price: 50},
+}
+
+// TestOption configures the middleware built by mockLsatMiddleware
+type TestOption func(lsatmiddleware *middleware.LsatMiddleware)
+
+// mockLsatMiddleware charges 10 sats per path, paid to lnClient
+func mockLsatMiddleware(lnClient *MockLNClient, options ...TestOption) *middleware.LsatMiddleware {
+	lsatmiddleware := &middleware.LsatMiddleware{
+		AmountFunc: FixedAmountFunc,
+		LNClient:   lnClient,
+		CaveatFunc: PathCaveat,
+		RootKey:    []byte(ROOT_KEY),
+	}
+	for _, option := range options {
+		option(lsatmiddleware)
 	}
-	amountInSats := SATS_PER_BTC * amountInBTC
-	return int64(amountInSats)
+	return lsatmiddleware
+}
+
+func withCookie() TestOption {
+	return func(lsatmiddleware *middleware.LsatMiddleware) {
+		lsatmiddleware.Cookie = &middleware.CookieConfig{}
+	}
+}
+
+func withUsageStore() TestOption {
+	return func(lsatmiddleware *middleware.LsatMiddleware) {
+		lsatmiddleware.UsageStore = middleware.NewMemoryUsageStore()
+	}
+}
+
+func withLedger(ledger middleware.Ledger, topUpMsat lnwire.MilliSatoshi) TestOption {
+	return func(lsatmiddleware *middleware.LsatMiddleware) {
+		lsatmiddleware.Ledger = ledger
+		lsatmiddleware.TopUpMsat = topUpMsat
+	}
+}
+
+// withTiers sells testTiers, /premium needs the premium tier
+func withTiers() TestOption {
+	return func(lsatmiddleware *middleware.LsatMiddleware) {
+		// LSATs are bound to a tier instead of a path
+		lsatmiddleware.CaveatFunc = nil
+		lsatmiddleware.Tiers = testTiers
+		lsatmiddleware.RequirementFunc = func(req *http.Request) *tier.Requirement {
+			if req.URL.Path == "/premium" {
+				return &tier.Requirement{Service: "api", Tier: 1, Capabilities: []string{"write"}}
+			}
+			return &tier.Requirement{Service: "api", Tier: 0, Capabilities: []string{"read"}}
+		}
+	}
+}
+
+// withPlan sells a monthly subscription of 100 sats lasting period
+func withPlan(period time.Duration) TestOption {
+	return func(lsatmiddleware *middleware.LsatMiddleware) {
+		lsatmiddleware.Plans = []middleware.Plan{{Name: "monthly", Period: period, Price: 100}}
+		lsatmiddleware.PlanFunc = func(req *http.Request) string {
+			return "monthly"
+		}
+		lsatmiddleware.Subscriptions = middleware.NewMemorySubscriptionStore()
+	}
+}
+
+// withHooks appends the hook calls to calls as "<hook> <LSAT type>"
+func withHooks(calls *[]string) TestOption {
+	return func(lsatmiddleware *middleware.LsatMiddleware) {
+		record := func(name string) middleware.Hook {
+			return func(req *http.Request, lsatInfo *lsat.LsatInfo, metadata *middleware.HookMetadata) {
+				*calls = append(*calls, fmt.Sprintf("%s %s", name, lsatInfo.Type))
+			}
+		}
+		lsatmiddleware.OnChallenge = record("challenge")
+		lsatmiddleware.OnInvoiceCreated = record("invoice")
+		lsatmiddleware.OnVerified = record("verified")
+		lsatmiddleware.OnRejected = record("rejected")
+		lsatmiddleware.OnFree = record("free")
+	}
+}
+
+// ginStrictLsatHandler serves /protected and /premium behind the
+// StrictHandler, next to the cookie, status and renewal endpoints
+func ginStrictLsatHandler(lsatmiddleware *ginlsat.GinLsat) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+
+	protected := func(c *gin.Context) {
+		c.JSON(http.StatusAccepted, gin.H{
+			"code":    http.StatusAccepted,
+			"message": lsat.PROTECTED_CONTENT_MESSAGE,
+		})
+	}
+	router.GET("/protected", lsatmiddleware.StrictHandler, protected)
+	router.GET("/premium", lsatmiddleware.StrictHandler, protected)
+	router.POST("/lsat/cookie", lsatmiddleware.CookieHandler)
+	router.GET("/lsat/status", lsatmiddleware.StatusHandler)
+	router.POST("/lsat/renew", lsatmiddleware.RenewalHandler)
+
+	return router
+}
+
+func echoStrictLsatHandler(lsatmiddleware *echolsat.EchoLsat) *echo.Echo {
+	router := echo.New()
+
+	protected := func(c echo.Context) error {
+		return c.JSON(http.StatusAccepted, map[string]interface{}{
+			"code":    http.StatusAccepted,
+			"message": lsat.PROTECTED_CONTENT_MESSAGE,
+		})
+	}
+	router.GET("/protected", protected, lsatmiddleware.StrictHandler)
+	router.GET("/premium", protected, lsatmiddleware.StrictHandler)
+	router.POST("/lsat/cookie", lsatmiddleware.CookieHandler)
+	router.GET("/lsat/status", lsatmiddleware.StatusHandler)
+	router.POST("/lsat/renew", lsatmiddleware.RenewalHandler)
+
+	return router
+}
+
+// strictLsatHandlers serves lsatmiddleware with gin and echo
+func strictLsatHandlers(lsatmiddleware *middleware.LsatMiddleware) map[string]http.Handler {
+	return map[string]http.Handler{
+		"gin":  ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware}),
+		"echo": echoStrictLsatHandler(&echolsat.EchoLsat{Middleware: *lsatmiddleware}),
+	}
+}
+
+// strictLsatHandler serves a mockLsatMiddleware with gin
+func strictLsatHandler(lnClient *MockLNClient, options ...TestOption) *gin.Engine {
+	return ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *mockLsatMiddleware(lnClient, options...)})
+}
+
+// buyTestLsat sends request to handler and returns the LSAT paying the
+// challenge it gets with the preimage of lnClient, along with the challenge
+func buyTestLsat(t *testing.T, lnClient *MockLNClient, handler http.Handler, request *gofight.RequestConfig) (string, gjson.Result) {
+	var challenge gjson.Result
+	request.Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+		assert.Equal(t, http.StatusPaymentRequired, res.Code)
+		challenge = gjson.Parse(res.Body.String())
+	})
+	macaroonString := challenge.Get("macaroon").String()
+	mac, err := utils.GetMacaroonFromString(macaroonString)
+	if !assert.NoError(t, err) {
+		return "", challenge
+	}
+	macaroonId, err := macaroonutils.GetMacIdFromMacaroon(mac)
+	assert.NoError(t, err)
+	preimage, ok := lnClient.Preimage(macaroonId.PaymentHash)
+	assert.True(t, ok)
+	return fmt.Sprintf("LSAT %s:%s", macaroonString, preimage), challenge
+}
+
+func requestStatus(handler http.Handler, path string, authorization string) int {
+	status := 0
+	gofight.New().GET(path).
+		SetHeader(gofight.H{"Authorization": authorization}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			status = res.Code
+		})
+	return status
+}
+
+func tokenId(t *testing.T, authorization string) [32]byte {
+	mac, _, err := utils.ParseLsatHeader(authorization)
+	assert.NoError(t, err)
+	macaroonId, err := macaroonutils.GetMacIdFromMacaroon(mac)
+	assert.NoError(t, err)
+	return macaroonId.TokenId
 }
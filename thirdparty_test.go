@@ -0,0 +1,156 @@
+package test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/lsat"
+	"github.com/getAlby/lsat-middleware/middleware"
+	"github.com/getAlby/lsat-middleware/utils"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+	"gopkg.in/macaroon.v2"
+)
+
+const TEST_DISCHARGER_LOCATION = "https://auth.example.com"
+
+var testDischargerKey = []byte("0123456789abcdef0123456789abcdef")
+
+// withDischarger requires a discharge from TEST_DISCHARGER_LOCATION
+func withDischarger() TestOption {
+	return func(lsatmiddleware *middleware.LsatMiddleware) {
+		lsatmiddleware.ThirdPartyCaveats = []caveat.ThirdPartyCaveat{{
+			Location:  TEST_DISCHARGER_LOCATION,
+			Condition: "member=gold",
+			Key:       testDischargerKey,
+		}}
+	}
+}
+
+func TestThirdPartyCaveats(t *testing.T) {
+	lnClient := &MockLNClient{}
+	handler := strictLsatHandler(lnClient, withDischarger())
+	authorization, _ := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+
+	// Without discharge the LSAT isn't accepted
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/protected", authorization))
+
+	var checked string
+	discharger := &caveat.Discharger{
+		Location: TEST_DISCHARGER_LOCATION,
+		Key:      testDischargerKey,
+		Check: func(ctx context.Context, condition string) error {
+			checked = condition
+			return nil
+		},
+		Caveats: func(condition string) []caveat.Caveat {
+			return []caveat.Caveat{caveat.ValidUntil(time.Now().Add(time.Minute))}
+		},
+	}
+	discharged, err := lsat.Discharge(context.Background(), authorization, discharger)
+	assert.NoError(t, err)
+	assert.Equal(t, "member=gold", checked)
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", discharged))
+
+	// Discharges are bound to the LSAT they were issued for
+	_, discharges, _, err := utils.ParseLsatHeaderWithDischarges(discharged)
+	assert.NoError(t, err)
+	other, _ := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	otherMac, _, err := utils.ParseLsatHeader(other)
+	assert.NoError(t, err)
+	stolen, err := macaroon.Slice{otherMac, discharges[0]}.MarshalBinary()
+	assert.NoError(t, err)
+	stolenAuthorization := fmt.Sprintf("LSAT %s:%s", base64.StdEncoding.EncodeToString(stolen), TEST_PREIMAGE_VALID)
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/protected", stolenAuthorization))
+
+	otherDischarged, err := lsat.Discharge(context.Background(), other, &caveat.Discharger{
+		Location: TEST_DISCHARGER_LOCATION,
+		Key:      testDischargerKey,
+	})
+	assert.NoError(t, err)
+	assert.NotEqual(t, discharged, otherDischarged)
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", otherDischarged))
+}
+
+func TestThirdPartyCaveatsRejected(t *testing.T) {
+	lnClient := &MockLNClient{}
+	handler := strictLsatHandler(lnClient, withDischarger())
+	authorization, _ := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+
+	_, err := lsat.Discharge(context.Background(), authorization, &caveat.Discharger{
+		Location: TEST_DISCHARGER_LOCATION,
+		Key:      testDischargerKey,
+		Check: func(ctx context.Context, condition string) error {
+			return errors.New("Not a gold member")
+		},
+	})
+	assert.Error(t, err)
+
+	// A discharger without the key can't recover the caveat
+	_, err = lsat.Discharge(context.Background(), authorization, &caveat.Discharger{
+		Location: TEST_DISCHARGER_LOCATION,
+		Key:      []byte("fedcba9876543210fedcba9876543210"),
+	})
+	assert.Error(t, err)
+
+	// First-party caveats of discharges have to hold
+	expired, err := lsat.Discharge(context.Background(), authorization, &caveat.Discharger{
+		Location: TEST_DISCHARGER_LOCATION,
+		Key:      testDischargerKey,
+		Caveats: func(condition string) []caveat.Caveat {
+			return []caveat.Caveat{caveat.ValidUntil(time.Now().Add(-time.Minute))}
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/protected", expired))
+}
+
+func TestThirdPartyCaveatsStatus(t *testing.T) {
+	lnClient := &MockLNClient{}
+	handler := strictLsatHandler(lnClient, withDischarger())
+	_, challenge := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+
+	// Paywalls poll with the challenge macaroon before it is discharged
+	gofight.New().GET("/lsat/status?macaroon="+url.QueryEscape(challenge.Get("macaroon").String())).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusOK, res.Code)
+			assert.Equal(t, middleware.INVOICE_STATUS_PENDING, gjson.Get(res.Body.String(), "status").String())
+		})
+}
+
+func TestThirdPartyCaveatsCookie(t *testing.T) {
+	lnClient := &MockLNClient{}
+	handler := strictLsatHandler(lnClient, withDischarger(), withCookie())
+	authorization, _ := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	discharged, err := lsat.Discharge(context.Background(), authorization, &caveat.Discharger{
+		Location: TEST_DISCHARGER_LOCATION,
+		Key:      testDischargerKey,
+	})
+	assert.NoError(t, err)
+
+	var cookies []*http.Cookie
+	gofight.New().POST("/lsat/cookie").
+		SetHeader(gofight.H{"Authorization": discharged}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusNoContent, res.Code)
+			cookies = (&http.Response{Header: res.HeaderMap}).Cookies()
+		})
+	if !assert.Len(t, cookies, 1) {
+		return
+	}
+	// The cookie carries the discharges along with the LSAT
+	gofight.New().GET("/protected").
+		SetCookie(gofight.H{cookies[0].Name: cookies[0].Value}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusAccepted, res.Code)
+		})
+}
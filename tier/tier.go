@@ -0,0 +1,199 @@
+package tier
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+)
+
+// SERVICES is the condition of the caveat listing the services an LSAT was
+// bought for with their tiers, e.g. services=api:1,files:0. The
+// capabilities of a service are restricted by a <service>_capabilities
+// caveat, e.g. api_capabilities=read,write, as in Aperture.
+const (
+	SERVICES            = "services"
+	CAPABILITIES_SUFFIX = "_capabilities"
+)
+
+type Service struct {
+	Name string
+	Tier uint8
+}
+
+func EncodeServices(services []Service) string {
+	encoded := make([]string, 0, len(services))
+	for _, service := range services {
+		encoded = append(encoded, fmt.Sprintf("%s:%d", service.Name, service.Tier))
+	}
+	return strings.Join(encoded, ",")
+}
+
+func DecodeServices(value string) ([]Service, error) {
+	services := []Service{}
+	for _, encoded := range strings.Split(value, ",") {
+		splitted := strings.Split(encoded, ":")
+		if len(splitted) != 2 || splitted[0] == "" {
+			return nil, fmt.Errorf("Invalid service: %q", encoded)
+		}
+		tier, err := strconv.ParseUint(splitted[1], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tier of service %s: %q", splitted[0], splitted[1])
+		}
+		services = append(services, Service{Name: splitted[0], Tier: uint8(tier)})
+	}
+	return services, nil
+}
+
+// Tier is a product one purchase unlocks: a service at a tier with its
+// capabilities, an empty list granting all of them. Higher tiers are
+// expected to cover lower ones.
+type Tier struct {
+	Service      string
+	Name         string
+	Level        uint8
+	Capabilities []string
+	// Price in sats, if zero the request is priced by the AmountFunc of
+	// the middleware
+	Price int64
+}
+
+// Caveats returns the caveats of LSATs bought for tier.
+func (tier *Tier) Caveats() []caveat.Caveat {
+	caveats := []caveat.Caveat{
+		caveat.NewCaveat(SERVICES, EncodeServices([]Service{{Name: tier.Service, Tier: tier.Level}})),
+	}
+	if len(tier.Capabilities) > 0 {
+		caveats = append(caveats, caveat.NewCaveat(tier.Service+CAPABILITIES_SUFFIX, strings.Join(tier.Capabilities, ",")))
+	}
+	return caveats
+}
+
+// Covers reports whether tier satisfies requirement.
+func (tier *Tier) Covers(requirement *Requirement) bool {
+	if tier.Service != requirement.Service || tier.Level < requirement.Tier {
+		return false
+	}
+	return len(tier.Capabilities) == 0 || containsAll(tier.Capabilities, requirement.Capabilities)
+}
+
+// Requirement is what a route needs from an LSAT: the service at Tier or
+// higher, with all of Capabilities.
+type Requirement struct {
+	Service      string
+	Tier         uint8
+	Capabilities []string
+}
+
+// Check verifies that caveats cover requirement. Every services and
+// capabilities caveat has to, so that caveats added by the holder can only
+// narrow what the LSAT covers.
+func Check(caveats []caveat.Caveat, requirement *Requirement) error {
+	found := false
+	for _, c := range caveats {
+		switch c.Condition {
+		case SERVICES:
+			services, err := DecodeServices(c.Value)
+			if err != nil {
+				return err
+			}
+			if !servicesCover(services, requirement) {
+				return fmt.Errorf("LSAT does not cover tier %d of service %s", requirement.Tier, requirement.Service)
+			}
+			found = true
+		case requirement.Service + CAPABILITIES_SUFFIX:
+			if !containsAll(strings.Split(c.Value, ","), requirement.Capabilities) {
+				return fmt.Errorf("LSAT lacks capabilities %s of service %s", strings.Join(requirement.Capabilities, ","), requirement.Service)
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("LSAT is not valid for service %s", requirement.Service)
+	}
+	return nil
+}
+
+// Select returns the tier to sell for requirement: the lowest level tier
+// covering it, the cheapest of those if several do.
+func Select(tiers []Tier, requirement *Requirement) (*Tier, error) {
+	candidates := []Tier{}
+	for _, tier := range tiers {
+		if tier.Covers(requirement) {
+			candidates = append(candidates, tier)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("No tier covers tier %d of service %s", requirement.Tier, requirement.Service)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Level != candidates[j].Level {
+			return candidates[i].Level < candidates[j].Level
+		}
+		return candidates[i].Price < candidates[j].Price
+	})
+	return &candidates[0], nil
+}
+
+// Held returns the tier of service an LSAT with caveats was bought for.
+// With repeated services caveats the lowest tier counts.
+func Held(tiers []Tier, caveats []caveat.Caveat, service string) (*Tier, bool) {
+	level, found := uint8(0), false
+	for _, c := range caveats {
+		if c.Condition != SERVICES {
+			continue
+		}
+		services, err := DecodeServices(c.Value)
+		if err != nil {
+			return nil, false
+		}
+		serviceFound := false
+		for _, s := range services {
+			if s.Name != service {
+				continue
+			}
+			serviceFound = true
+			if !found || s.Tier < level {
+				level, found = s.Tier, true
+			}
+		}
+		if !serviceFound {
+			return nil, false
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	for i := range tiers {
+		if tiers[i].Service == service && tiers[i].Level == level {
+			return &tiers[i], true
+		}
+	}
+	return nil, false
+}
+
+func servicesCover(services []Service, requirement *Requirement) bool {
+	for _, service := range services {
+		if service.Name == requirement.Service && service.Tier >= requirement.Tier {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAll(values []string, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, value := range values {
+			if value == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
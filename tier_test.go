@@ -0,0 +1,56 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/lsat"
+	"github.com/getAlby/lsat-middleware/tier"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceTiers(t *testing.T) {
+	lnClient := &MockLNClient{}
+	handler := strictLsatHandler(lnClient, withTiers())
+
+	basic, challenge := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	assert.Equal(t, int64(10), challenge.Get("amount").Int())
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", basic))
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/premium", basic))
+
+	premium, challenge := buyTestLsat(t, lnClient, handler, gofight.New().GET("/premium"))
+	assert.Equal(t, int64(50), challenge.Get("amount").Int())
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/premium", premium))
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", premium))
+
+	// Holders can give away a premium LSAT restricted to read access
+	readOnly, err := lsat.Attenuate(premium, []caveat.Caveat{caveat.NewCaveat("api"+tier.CAPABILITIES_SUFFIX, "read")})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", readOnly))
+	assert.Equal(t, http.StatusPaymentRequired, requestStatus(handler, "/premium", readOnly))
+}
+
+func TestTierCheck(t *testing.T) {
+	services, err := tier.DecodeServices("api:1,files:0")
+	assert.NoError(t, err)
+	assert.Equal(t, []tier.Service{{Name: "api", Tier: 1}, {Name: "files", Tier: 0}}, services)
+	assert.Equal(t, "api:1,files:0", tier.EncodeServices(services))
+	_, err = tier.DecodeServices("api:high")
+	assert.Error(t, err)
+
+	requirement := &tier.Requirement{Service: "api", Tier: 1, Capabilities: []string{"write"}}
+	assert.NoError(t, tier.Check(testTiers[1].Caveats(), requirement))
+	assert.Error(t, tier.Check(testTiers[0].Caveats(), requirement))
+	assert.Error(t, tier.Check(nil, requirement))
+	// A repeated services caveat narrows the tier
+	assert.Error(t, tier.Check(append(testTiers[1].Caveats(), caveat.NewCaveat(tier.SERVICES, "api:0")), requirement))
+
+	selected, err := tier.Select(testTiers, &tier.Requirement{Service: "api", Capabilities: []string{"read"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "basic", selected.Name)
+	_, err = tier.Select(testTiers, &tier.Requirement{Service: "api", Capabilities: []string{"admin"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,44 @@
+package tracing
+
+import (
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans are recorded with the global TracerProvider, see otel.SetTracerProvider.
+const TRACER_NAME = "github.com/getAlby/lsat-middleware"
+
+const (
+	ATTRIBUTE_ROUTE       = attribute.Key("lsat.route")
+	ATTRIBUTE_AMOUNT_MSAT = attribute.Key("lsat.amount_msat")
+	ATTRIBUTE_BACKEND     = attribute.Key("lsat.backend")
+	ATTRIBUTE_REASON      = attribute.Key("lsat.reason")
+)
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(TRACER_NAME)
+}
+
+// RecordError marks span as failed if err is set.
+func RecordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// RecordReason marks span as failed if err is set, recording only reason
+// and the type of err. Use it for errors whose messages may contain the
+// token.
+func RecordReason(span trace.Span, reason string, err error) {
+	if err != nil {
+		span.SetAttributes(ATTRIBUTE_REASON.String(reason))
+		span.AddEvent("exception", trace.WithAttributes(
+			attribute.String("exception.type", fmt.Sprintf("%T", err))))
+		span.SetStatus(codes.Error, reason)
+	}
+}
@@ -0,0 +1,103 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/ln"
+	"github.com/getAlby/lsat-middleware/lsat"
+	"github.com/getAlby/lsat-middleware/tracing"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+	})
+	return recorder
+}
+
+func spansByName(recorder *tracetest.SpanRecorder) map[string]sdktrace.ReadOnlySpan {
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	recorder := recordSpans(t)
+
+	preimage, err := lntypes.MakePreimageFromStr(TEST_PREIMAGE_VALID)
+	assert.NoError(t, err)
+	invoice, err := NewTestInvoice(preimage.Hash(), 10000)
+	assert.NoError(t, err)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"pr": invoice})
+	}))
+	defer callback.Close()
+
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{})
+	lsatmiddleware.LNClient = &ln.LnAddressUrlResJson{Callback: callback.URL}
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	gofight.New().GET("/protected").
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPaymentRequired, res.Code)
+		})
+	spans := spansByName(recorder)
+	challengeSpan := spans["lsat.CreateChallenge"]
+	addInvoiceSpan := spans["LNURL.AddInvoice"]
+	if assert.NotNil(t, challengeSpan) && assert.NotNil(t, addInvoiceSpan) {
+		assert.Contains(t, challengeSpan.Attributes(), tracing.ATTRIBUTE_ROUTE.String("/protected"))
+		assert.Contains(t, challengeSpan.Attributes(), tracing.ATTRIBUTE_BACKEND.String(ln.LNURL_CLIENT_TYPE))
+		assert.Contains(t, addInvoiceSpan.Attributes(), tracing.ATTRIBUTE_AMOUNT_MSAT.Int64(10000))
+		assert.Equal(t, challengeSpan.SpanContext().SpanID(), addInvoiceSpan.Parent().SpanID())
+	}
+
+	gofight.New().GET("/protected").
+		SetHeader(gofight.H{
+			"Authorization": fmt.Sprintf("LSAT %s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_VALID),
+		}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusAccepted, res.Code)
+		})
+	spans = spansByName(recorder)
+	verifySpan := spans["lsat.VerifyRequest"]
+	for _, name := range []string{"lsat.ParseLsatHeader", "lsat.VerifySignature", "lsat.VerifyCaveats"} {
+		if assert.NotNil(t, spans[name], name) && assert.NotNil(t, verifySpan) {
+			assert.Equal(t, verifySpan.SpanContext().SpanID(), spans[name].Parent().SpanID())
+		}
+	}
+
+	gofight.New().GET("/protected").
+		SetHeader(gofight.H{
+			"Authorization": fmt.Sprintf("LSAT %s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_INVALID),
+		}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {})
+	spans = spansByName(recorder)
+	assert.Equal(t, codes.Error, spans["lsat.VerifyRequest"].Status().Code)
+	assert.Equal(t, codes.Unset, spans["lsat.VerifyCaveats"].Status().Code)
+	// Only the reason is recorded, the error names the preimage
+	assert.Equal(t, lsat.REASON_INVALID_PREIMAGE, spans["lsat.VerifyRequest"].Status().Description)
+	assert.Contains(t, spans["lsat.VerifyRequest"].Attributes(), tracing.ATTRIBUTE_REASON.String(lsat.REASON_INVALID_PREIMAGE))
+	for _, event := range spans["lsat.VerifyRequest"].Events() {
+		for _, attribute := range event.Attributes {
+			assert.NotContains(t, attribute.Value.Emit(), TEST_PREIMAGE_INVALID)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/caveat"
+	"github.com/getAlby/lsat-middleware/lsat"
+	"github.com/getAlby/lsat-middleware/utils"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTierUpgrade(t *testing.T) {
+	lnClient := &MockLNClient{}
+	handler := strictLsatHandler(lnClient, withTiers())
+	basic, _ := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+	validUntil := caveat.ValidUntil(time.Now().Add(time.Hour))
+	basic, err := lsat.Attenuate(basic, []caveat.Caveat{validUntil})
+	assert.NoError(t, err)
+
+	upgraded, body := buyTestLsat(t, lnClient, handler, gofight.New().GET("/premium").
+		SetHeader(gofight.H{"Authorization": basic}))
+	assert.True(t, body.Get("upgrade").Bool())
+	assert.Equal(t, int64(40), body.Get("amount").Int())
+	assert.Equal(t, tokenId(t, basic), tokenId(t, upgraded))
+
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/premium", upgraded))
+	assert.Equal(t, http.StatusAccepted, requestStatus(handler, "/protected", upgraded))
+
+	// The upgrade keeps the expiry of the original LSAT
+	mac, _, err := utils.ParseLsatHeader(upgraded)
+	assert.NoError(t, err)
+	preimage, err := utils.GetPreimageFromString(TEST_PREIMAGE_VALID)
+	assert.NoError(t, err)
+	lsatInfo, err := lsat.GetPaidLsatInfo(mac, preimage)
+	assert.NoError(t, err)
+	assert.Contains(t, lsatInfo.Caveats, validUntil)
+}
+
+func TestTierUpgradeRefused(t *testing.T) {
+	lnClient := &MockLNClient{}
+	handler := strictLsatHandler(lnClient, withTiers(), withUsageStore())
+	basic, _ := buyTestLsat(t, lnClient, handler, gofight.New().GET("/protected"))
+
+	// Upgrading would drop the max_uses caveat, so a full price LSAT is sold
+	limited, err := lsat.Attenuate(basic, []caveat.Caveat{caveat.MaxUses(1)})
+	assert.NoError(t, err)
+	replacement, body := buyTestLsat(t, lnClient, handler, gofight.New().GET("/premium").
+		SetHeader(gofight.H{"Authorization": limited}))
+	assert.False(t, body.Get("upgrade").Bool())
+	assert.Equal(t, int64(50), body.Get("amount").Int())
+	assert.NotEqual(t, tokenId(t, basic), tokenId(t, replacement))
+}
@@ -12,35 +12,43 @@ import (
 )
 
 func ParseLsatHeader(authField string) (*macaroon.Macaroon, lntypes.Preimage, error) {
+	mac, _, preimage, err := ParseLsatHeaderWithDischarges(authField)
+	return mac, preimage, err
+}
+
+// ParseLsatHeaderWithDischarges is ParseLsatHeader for LSATs with
+// third-party caveats, whose macaroon field holds the LSAT macaroon followed
+// by the bound discharge macaroons.
+func ParseLsatHeaderWithDischarges(authField string) (*macaroon.Macaroon, []*macaroon.Macaroon, lntypes.Preimage, error) {
 	// A typical authField
 	// Authorization: LSAT AGIAJEemVQUTEyNCR0exk7ek90Cg==:1234abcd1234abcd1234abcd
 	if len(authField) == 0 {
-		return nil, lntypes.Preimage{}, fmt.Errorf("Authorization Field not present")
+		return nil, nil, lntypes.Preimage{}, fmt.Errorf("Authorization Field not present")
 	}
 	// Trim leading and trailing spaces
 	authField = strings.TrimSpace(authField)
 	if len(authField) == 0 {
-		return nil, lntypes.Preimage{}, fmt.Errorf("LSAT Header is not present")
+		return nil, nil, lntypes.Preimage{}, fmt.Errorf("LSAT Header is not present")
 	}
 	// Trim LSAT prefix
 	token := strings.TrimPrefix(authField, "LSAT ")
 	splitted := strings.Split(token, ":")
 	if len(splitted) != 2 {
-		return nil, lntypes.Preimage{}, fmt.Errorf("LSAT does not have the right format: %s", authField)
+		return nil, nil, lntypes.Preimage{}, fmt.Errorf("LSAT does not have the right format: %s", authField)
 	}
 	macaroonString := strings.TrimSpace(splitted[0])
 	preimageString := strings.TrimSpace(splitted[1])
 
-	mac, err := GetMacaroonFromString(macaroonString)
+	macs, err := GetMacaroonsFromString(macaroonString)
 	if err != nil {
-		return nil, lntypes.Preimage{}, err
+		return nil, nil, lntypes.Preimage{}, err
 	}
 
 	preimage, err := GetPreimageFromString(preimageString)
 	if err != nil {
-		return mac, lntypes.Preimage{}, err
+		return macs[0], macs[1:], lntypes.Preimage{}, err
 	}
-	return mac, preimage, nil
+	return macs[0], macs[1:], preimage, nil
 }
 
 func ParseLnAddress(address string) (string, string, error) {
@@ -69,6 +77,25 @@ func GetMacaroonFromString(macaroonString string) (*macaroon.Macaroon, error) {
 	return mac, nil
 }
 
+// GetMacaroonsFromString decodes one or more concatenated macaroons.
+func GetMacaroonsFromString(macaroonString string) (macaroon.Slice, error) {
+	if len(macaroonString) == 0 || !IsBase64(macaroonString) {
+		return nil, fmt.Errorf("Invalid macaroon string")
+	}
+	macBytes, err := base64.StdEncoding.DecodeString(macaroonString)
+	if err != nil {
+		return nil, err
+	}
+	macs := macaroon.Slice{}
+	if err := macs.UnmarshalBinary(macBytes); err != nil {
+		return nil, err
+	}
+	if len(macs) == 0 {
+		return nil, fmt.Errorf("Invalid macaroon string")
+	}
+	return macs, nil
+}
+
 func GetPreimageFromString(preimageString string) (lntypes.Preimage, error) {
 	if len(preimageString) == 0 || !IsHex(preimageString) {
 		return lntypes.Preimage{}, fmt.Errorf("Invalid preimage string")
@@ -0,0 +1,310 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_INVOICE_CREATED  = "invoice.created"
+	EVENT_INVOICE_SETTLED  = "invoice.settled"
+	EVENT_TOKEN_FIRST_USED = "token.first_used"
+	EVENT_TOKEN_REJECTED   = "token.rejected"
+)
+
+const (
+	SIGNATURE_HEADER = "X-Lsat-Signature"
+	EVENT_HEADER     = "X-Lsat-Event"
+)
+
+const (
+	DEFAULT_QUEUE_SIZE    = 1000
+	DEFAULT_WORKERS       = 4
+	DEFAULT_MAX_ATTEMPTS  = 5
+	DEFAULT_RETRY_BACKOFF = time.Second
+	DEFAULT_TIMEOUT       = 10 * time.Second
+	// How many token IDs are remembered to only send token.first_used once
+	DEFAULT_SEEN_TOKENS = 100000
+)
+
+var (
+	ErrQueueFull = errors.New("Webhook queue is full")
+	ErrClosed    = errors.New("Webhook dispatcher is closed")
+)
+
+type Target struct {
+	URL string
+	// Secret the body is signed with, see VerifySignature
+	Secret []byte
+	// Events to deliver, all events if empty
+	Events []string
+}
+
+type Event struct {
+	Id        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	CreatedAt time.Time              `json:"created_at"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+type Config struct {
+	Targets []Target
+	// QueueSize bounds the deliveries waiting to be sent, events that don't
+	// fit are handed to OnDeadLetter right away
+	QueueSize    int
+	Workers      int
+	MaxAttempts  int
+	RetryBackoff time.Duration
+	HTTPClient   *http.Client
+	// OnDeadLetter is called for deliveries that failed MaxAttempts times or
+	// couldn't be queued. It's never called with the dispatcher locked, but
+	// deliveries that failed are reported from a worker, which Close waits for
+	OnDeadLetter func(target Target, event *Event, err error)
+	SeenTokens   int
+}
+
+// Dispatcher delivers events to the webhook targets in the background.
+type Dispatcher struct {
+	config Config
+	queue  chan *delivery
+	wg     sync.WaitGroup
+
+	mu         sync.RWMutex
+	closed     bool
+	seenTokens map[string]struct{}
+	seenOrder  []string
+}
+
+type delivery struct {
+	target Target
+	event  *Event
+}
+
+type deadLetter struct {
+	target Target
+	err    error
+}
+
+func NewDispatcher(config Config) *Dispatcher {
+	if config.QueueSize <= 0 {
+		config.QueueSize = DEFAULT_QUEUE_SIZE
+	}
+	if config.Workers <= 0 {
+		config.Workers = DEFAULT_WORKERS
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = DEFAULT_RETRY_BACKOFF
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: DEFAULT_TIMEOUT}
+	}
+	if config.SeenTokens <= 0 {
+		config.SeenTokens = DEFAULT_SEEN_TOKENS
+	}
+	dispatcher := &Dispatcher{
+		config:     config,
+		queue:      make(chan *delivery, config.QueueSize),
+		seenTokens: make(map[string]struct{}),
+	}
+	for i := 0; i < config.Workers; i++ {
+		dispatcher.wg.Add(1)
+		go dispatcher.work()
+	}
+	return dispatcher
+}
+
+// Send queues the event for every target subscribed to its type. It never
+// blocks.
+func (dispatcher *Dispatcher) Send(eventType string, data map[string]interface{}) {
+	event, err := newEvent(eventType, data)
+	if err != nil {
+		return
+	}
+	// Dead letters are passed on once the lock is released, so that
+	// OnDeadLetter may call back into the dispatcher
+	deadLetters := []deadLetter{}
+	dispatcher.mu.RLock()
+	for _, target := range dispatcher.config.Targets {
+		if !target.wants(eventType) {
+			continue
+		}
+		if dispatcher.closed {
+			deadLetters = append(deadLetters, deadLetter{target, ErrClosed})
+			continue
+		}
+		select {
+		case dispatcher.queue <- &delivery{target: target, event: event}:
+		default:
+			deadLetters = append(deadLetters, deadLetter{target, ErrQueueFull})
+		}
+	}
+	dispatcher.mu.RUnlock()
+	for _, letter := range deadLetters {
+		dispatcher.deadLetter(letter.target, event, letter.err)
+	}
+}
+
+// FirstUse reports whether tokenId is seen for the first time. Only the
+// most recent SeenTokens token IDs are remembered.
+func (dispatcher *Dispatcher) FirstUse(tokenId string) bool {
+	dispatcher.mu.Lock()
+	defer dispatcher.mu.Unlock()
+	if _, ok := dispatcher.seenTokens[tokenId]; ok {
+		return false
+	}
+	if len(dispatcher.seenOrder) >= dispatcher.config.SeenTokens {
+		delete(dispatcher.seenTokens, dispatcher.seenOrder[0])
+		dispatcher.seenOrder = dispatcher.seenOrder[1:]
+	}
+	dispatcher.seenTokens[tokenId] = struct{}{}
+	dispatcher.seenOrder = append(dispatcher.seenOrder, tokenId)
+	return true
+}
+
+// Close stops accepting events and waits until the queued deliveries have
+// been delivered or dead-lettered.
+func (dispatcher *Dispatcher) Close() {
+	dispatcher.mu.Lock()
+	if dispatcher.closed {
+		dispatcher.mu.Unlock()
+		return
+	}
+	dispatcher.closed = true
+	close(dispatcher.queue)
+	dispatcher.mu.Unlock()
+	dispatcher.wg.Wait()
+}
+
+func (dispatcher *Dispatcher) work() {
+	defer dispatcher.wg.Done()
+	for delivery := range dispatcher.queue {
+		dispatcher.deliver(delivery)
+	}
+}
+
+func (dispatcher *Dispatcher) deliver(delivery *delivery) {
+	backoff := dispatcher.config.RetryBackoff
+	var err error
+	for attempt := 1; attempt <= dispatcher.config.MaxAttempts; attempt++ {
+		if err = dispatcher.post(delivery); err == nil {
+			return
+		}
+		if attempt == dispatcher.config.MaxAttempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	dispatcher.deadLetter(delivery.target, delivery.event, err)
+}
+
+func (dispatcher *Dispatcher) post(delivery *delivery) error {
+	body, err := json.Marshal(delivery.event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, delivery.target.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EVENT_HEADER, delivery.event.Type)
+	req.Header.Set(SIGNATURE_HEADER, Sign(delivery.target.Secret, time.Now(), body))
+	res, err := dispatcher.config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Webhook %s responded with %d", delivery.target.URL, res.StatusCode)
+	}
+	return nil
+}
+
+func (dispatcher *Dispatcher) deadLetter(target Target, event *Event, err error) {
+	if dispatcher.config.OnDeadLetter != nil {
+		dispatcher.config.OnDeadLetter(target, event, err)
+	}
+}
+
+func (target *Target) wants(eventType string) bool {
+	if len(target.Events) == 0 {
+		return true
+	}
+	for _, event := range target.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func newEvent(eventType string, data map[string]interface{}) (*Event, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	return &Event{
+		Id:        hex.EncodeToString(id[:]),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}, nil
+}
+
+// Sign returns the signature header for body: "t=<unix time>,v1=<hex
+// HMAC-SHA256 of "<unix time>.<body>">". Signing the time lets receivers
+// reject replayed deliveries.
+func Sign(secret []byte, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", t, hex.EncodeToString(computeMAC(secret, t, body)))
+}
+
+// VerifySignature checks a signature header made by Sign, rejecting ones
+// older than tolerance.
+func VerifySignature(secret []byte, signatureHeader string, body []byte, tolerance time.Duration) error {
+	var t, v1 string
+	for _, part := range strings.Split(signatureHeader, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			t = value
+		case "v1":
+			v1 = value
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || v1 == "" {
+		return errors.New("Malformed webhook signature")
+	}
+	if time.Since(time.Unix(unix, 0)) > tolerance {
+		return errors.New("Webhook signature has expired")
+	}
+	signature, err := hex.DecodeString(v1)
+	if err != nil || !hmac.Equal(signature, computeMAC(secret, t, body)) {
+		return errors.New("Invalid webhook signature")
+	}
+	return nil
+}
+
+func computeMAC(secret []byte, t string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
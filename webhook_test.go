@@ -0,0 +1,169 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getAlby/lsat-middleware/ginlsat"
+	"github.com/getAlby/lsat-middleware/lsat"
+	"github.com/getAlby/lsat-middleware/webhook"
+
+	"github.com/appleboy/gofight/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+const TEST_WEBHOOK_SECRET = "webhook secret"
+
+type webhookReceiver struct {
+	mu     sync.Mutex
+	events []string
+	bodies []string
+}
+
+func (receiver *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	if err := webhook.VerifySignature([]byte(TEST_WEBHOOK_SECRET), req.Header.Get(webhook.SIGNATURE_HEADER), body, time.Minute); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	receiver.events = append(receiver.events, gjson.GetBytes(body, "type").String())
+	receiver.bodies = append(receiver.bodies, string(body))
+}
+
+func (receiver *webhookReceiver) Events() []string {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	return append([]string{}, receiver.events...)
+}
+
+func (receiver *webhookReceiver) Bodies() []string {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	return append([]string{}, receiver.bodies...)
+}
+
+func TestWebhooks(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	dispatcher := webhook.NewDispatcher(webhook.Config{
+		Targets: []webhook.Target{
+			{URL: server.URL, Secret: []byte(TEST_WEBHOOK_SECRET)},
+		},
+		Workers: 1,
+	})
+	lsatmiddleware := mockLsatMiddleware(&MockLNClient{})
+	lsatmiddleware.Webhooks = dispatcher
+	handler := ginStrictLsatHandler(&ginlsat.GinLsat{Middleware: *lsatmiddleware})
+
+	gofight.New().GET("/protected").
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPaymentRequired, res.Code)
+		})
+	for i := 0; i < 2; i++ {
+		gofight.New().GET("/protected").
+			SetHeader(gofight.H{
+				"Authorization": fmt.Sprintf("LSAT %s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_VALID),
+			}).
+			Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+				assert.Equal(t, http.StatusAccepted, res.Code)
+			})
+	}
+	gofight.New().GET("/protected").
+		SetHeader(gofight.H{
+			"Authorization": fmt.Sprintf("LSAT %s:%s", TEST_MACAROON_VALID, TEST_PREIMAGE_INVALID),
+		}).
+		Run(handler, func(res gofight.HTTPResponse, req gofight.HTTPRequest) {
+			assert.Equal(t, http.StatusPaymentRequired, res.Code)
+		})
+	dispatcher.Close()
+
+	assert.Equal(t, []string{
+		webhook.EVENT_INVOICE_CREATED,
+		webhook.EVENT_TOKEN_FIRST_USED,
+		webhook.EVENT_TOKEN_REJECTED,
+		webhook.EVENT_INVOICE_CREATED,
+	}, receiver.Events())
+	// Rejections carry the reason, not the error with the token
+	rejected := receiver.Bodies()[2]
+	assert.Equal(t, lsat.REASON_INVALID_PREIMAGE, gjson.Get(rejected, "data.reason").String())
+	assert.NotContains(t, rejected, TEST_PREIMAGE_INVALID)
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	deadLetters := make(chan error, 1)
+	dispatcher := webhook.NewDispatcher(webhook.Config{
+		Targets: []webhook.Target{
+			{URL: server.URL, Secret: []byte(TEST_WEBHOOK_SECRET), Events: []string{webhook.EVENT_INVOICE_SETTLED}},
+		},
+		Workers:      1,
+		MaxAttempts:  3,
+		RetryBackoff: time.Millisecond,
+		OnDeadLetter: func(target webhook.Target, event *webhook.Event, err error) {
+			deadLetters <- err
+		},
+	})
+	// Not subscribed to by the target
+	dispatcher.Send(webhook.EVENT_INVOICE_CREATED, nil)
+	dispatcher.Send(webhook.EVENT_INVOICE_SETTLED, map[string]interface{}{"payment_hash": "00"})
+	dispatcher.Close()
+
+	assert.Error(t, <-deadLetters)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+
+	dispatcher.Send(webhook.EVENT_INVOICE_SETTLED, nil)
+	assert.ErrorIs(t, <-deadLetters, webhook.ErrClosed)
+}
+
+func TestWebhookDeadLetterCallback(t *testing.T) {
+	var dispatcher *webhook.Dispatcher
+	dispatcher = webhook.NewDispatcher(webhook.Config{
+		Targets: []webhook.Target{{URL: "http://127.0.0.1:0", Secret: []byte(TEST_WEBHOOK_SECRET)}},
+		OnDeadLetter: func(target webhook.Target, event *webhook.Event, err error) {
+			// Calls back into the dispatcher, which must not be locked
+			dispatcher.Close()
+			dispatcher.FirstUse(event.Id)
+		},
+	})
+	dispatcher.Close()
+
+	sent := make(chan struct{})
+	go func() {
+		dispatcher.Send(webhook.EVENT_INVOICE_SETTLED, nil)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Send deadlocked in OnDeadLetter")
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"type":"invoice.created"}`)
+	signature := webhook.Sign([]byte(TEST_WEBHOOK_SECRET), time.Now(), body)
+
+	assert.NoError(t, webhook.VerifySignature([]byte(TEST_WEBHOOK_SECRET), signature, body, time.Minute))
+	assert.Error(t, webhook.VerifySignature([]byte("other secret"), signature, body, time.Minute))
+	assert.Error(t, webhook.VerifySignature([]byte(TEST_WEBHOOK_SECRET), signature, []byte(`{}`), time.Minute))
+
+	oldSignature := webhook.Sign([]byte(TEST_WEBHOOK_SECRET), time.Now().Add(-time.Hour), body)
+	assert.Error(t, webhook.VerifySignature([]byte(TEST_WEBHOOK_SECRET), oldSignature, body, time.Minute))
+}